@@ -0,0 +1,314 @@
+package jikan
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// AggregateFunc is the way that the values in each bucket are combined by
+// Stream.Aggregate.
+type AggregateFunc uint8
+
+const (
+	AGGREGATE_COUNT AggregateFunc = iota
+	AGGREGATE_SUM
+	AGGREGATE_MIN
+	AGGREGATE_MAX
+	AGGREGATE_MEAN
+	AGGREGATE_FIRST
+	AGGREGATE_LAST
+	AGGREGATE_STDDEV
+	AGGREGATE_PERCENTILE
+)
+
+var aggregateNames = []string{"count", "sum", "min", "max", "mean", "first", "last", "stddev", "percentile"}
+
+var (
+	ERR_BAD_AGGREGATION = errors.New("unknown aggregation, or one that doesn't fit the stream")
+)
+
+// An Aggregation says how to combine the values in each bucket.
+type Aggregation struct {
+	Func AggregateFunc
+
+	// Field is the index of the field to aggregate, for streams with more than
+	// one.
+	Field int
+
+	// Percentile is the percentile to find, from 0 to 100, for
+	// AGGREGATE_PERCENTILE.
+	Percentile float64
+}
+
+// ParseAggregation turns the name of a function ("count", "sum", "min", "max",
+// "mean", "first", "last" or "stddev") into an Aggregation. Percentiles are
+// written as "p" and the percentile, like "p99" or "p99.9".
+func ParseAggregation(s string) (Aggregation, error) {
+	if strings.HasPrefix(s, "p") && len(s) > 1 {
+		p, err := strconv.ParseFloat(s[1:], 64)
+		if err != nil || p < 0 || p > 100 {
+			return Aggregation{}, ERR_BAD_AGGREGATION
+		}
+
+		return Aggregation{Func: AGGREGATE_PERCENTILE, Percentile: p}, nil
+	}
+
+	for i, name := range aggregateNames[:AGGREGATE_PERCENTILE] {
+		if name == s {
+			return Aggregation{Func: AggregateFunc(i)}, nil
+		}
+	}
+
+	return Aggregation{}, ERR_BAD_AGGREGATION
+}
+
+func (f AggregateFunc) String() string {
+	if int(f) < len(aggregateNames) {
+		return aggregateNames[f]
+	}
+
+	return "unknown"
+}
+
+// String returns the name of the aggregation, as ParseAggregation takes it.
+func (a Aggregation) String() string {
+	if a.Func == AGGREGATE_PERCENTILE {
+		return "p" + strconv.FormatFloat(a.Percentile, 'f', -1, 64)
+	}
+
+	return a.Func.String()
+}
+
+func (a Aggregation) valid(fields int) bool {
+	if a.Func > AGGREGATE_PERCENTILE || a.Field < 0 || a.Field >= fields {
+		return false
+	}
+
+	return a.Func != AGGREGATE_PERCENTILE || (a.Percentile >= 0 && a.Percentile <= 100)
+}
+
+// A Bucket is the result of aggregating the points in one step of time,
+// starting at Start. Count is the number of points that were in it.
+type Bucket struct {
+	Start time.Time
+	Count uint64
+	Value float64
+}
+
+// Aggregate divides the time from from up to (but not including) to into
+// buckets, step long, and combines the values in each one with fn. Buckets
+// with no points in them are left out. If from is zero, the buckets start at
+// the first point; if to is zero, they go on to the last. A step of zero puts
+// everything in one bucket.
+//
+// Values are combined as floats, so sums of very large integers lose
+// precision, and the standard deviation is that of the whole population of
+// the bucket.
+//
+// Blocks keep a summary of the first field in their headers, so counts, sums,
+// minimums, maximums, means, firsts and lasts of it don't have to decode the
+// blocks that fall entirely within one bucket, unless there are points that
+// were added out of order in the range, or the stream keeps the last of points
+// at the same time.
+func (s *Stream) Aggregate(from, to time.Time, step time.Duration, fn Aggregation) ([]Bucket, error) {
+	log.Debugf("aggregating `%s' from %s to %s by %s, %s\n", s.id, from, to, step, fn.Func)
+
+	if step < 0 || !fn.valid(len(s.Fields())) {
+		return nil, ERR_BAD_AGGREGATION
+	}
+
+	var buckets []Bucket
+	var acc accumulator
+	var start time.Time
+
+	bucket := func(t time.Time) time.Time {
+		if step > 0 {
+			return from.Add(t.Sub(from) / step * step)
+		}
+
+		return from
+	}
+
+	// move on to a new bucket if t isn't in the current one
+	move := func(t time.Time) {
+		b := bucket(t)
+
+		if acc.count > 0 && !b.Equal(start) {
+			buckets = append(buckets, acc.bucket(start, fn))
+			acc = accumulator{}
+		}
+
+		start = b
+	}
+
+	// late points could be anywhere, so if there are any in the range, the
+	// points have to be read in order instead. so do streams where points can
+	// be replaced, and ranges with deleted or updated points in them, since the
+	// iterator skips those.
+	if s.lateBetween(from, to) || s.duplicates == DUPLICATES_KEEP_LAST || s.tombstonesBetween(from, to) {
+		for it := s.Iterator().From(from); it.Good(); {
+			if !to.IsZero() && !it.Time.Before(to) {
+				break
+			}
+
+			if from.IsZero() {
+				from = it.Time
+			}
+
+			move(it.Time)
+			acc.add(it.FloatField(fn.Field), fn.Func == AGGREGATE_PERCENTILE)
+
+			if err := it.Next(); err != nil {
+				return nil, stackerr.Wrap(err)
+			}
+		}
+	} else {
+		for _, blk := range s.chain {
+			// empty blocks can only be found at the end of the chain
+			if blk.count == 0 || (!to.IsZero() && !blk.startTime.Before(to)) {
+				break
+			}
+
+			if !from.IsZero() && blk.time.Before(from) {
+				continue
+			}
+
+			if from.IsZero() {
+				from = blk.startTime
+			}
+
+			inside := !blk.startTime.Before(from) && (to.IsZero() || blk.time.Before(to))
+
+			if inside && fn.summarizable() && blk.summarized() && bucket(blk.startTime).Equal(bucket(blk.time)) {
+				log.Debugf("using summary of block at %d\n", blk.position)
+
+				move(blk.startTime)
+				acc.merge(uint64(blk.count), blk.summary, blk.types[0].float(blk.startValue), blk.types[0].float(blk.values[0]))
+
+				continue
+			}
+
+			typ := blk.types[fn.Field]
+
+			err := blk.points(func(t time.Time, vs []int64) error {
+				if t.Before(from) || (!to.IsZero() && !t.Before(to)) {
+					return nil
+				}
+
+				move(t)
+				acc.add(typ.float(vs[fn.Field]), fn.Func == AGGREGATE_PERCENTILE)
+
+				return nil
+			})
+			if err != nil {
+				return nil, stackerr.Wrap(err)
+			}
+		}
+	}
+
+	if acc.count > 0 {
+		buckets = append(buckets, acc.bucket(start, fn))
+	}
+
+	return buckets, nil
+}
+
+// summarizable reports whether the aggregation can be worked out from block
+// summaries, which only cover the first field.
+func (a Aggregation) summarizable() bool {
+	return a.Field == 0 && a.Func <= AGGREGATE_LAST
+}
+
+// accumulator keeps what's needed to work out any of the aggregations for one
+// bucket. the mean and variance are kept as in Welford's algorithm, which
+// doesn't lose precision the way that keeping a sum of squares does. values
+// are only kept for percentiles.
+type accumulator struct {
+	count       uint64
+	sum         float64
+	min, max    float64
+	first, last float64
+	mean, m2    float64
+	values      []float64
+}
+
+func (a *accumulator) add(v float64, keep bool) {
+	if a.count == 0 {
+		a.min, a.max, a.first = v, v, v
+	}
+
+	a.count++
+	a.sum += v
+	a.min = math.Min(a.min, v)
+	a.max = math.Max(a.max, v)
+	a.last = v
+
+	d := v - a.mean
+	a.mean += d / float64(a.count)
+	a.m2 += d * (v - a.mean)
+
+	if keep {
+		a.values = append(a.values, v)
+	}
+}
+
+// merge adds a whole block's points from its summary. the summary has no
+// variance, so this is never used for the standard deviation, and leaves the
+// mean as it was.
+func (a *accumulator) merge(count uint64, s blockSummary, first, last float64) {
+	if a.count == 0 {
+		a.min, a.max, a.first = s.min, s.max, first
+	}
+
+	a.count += count
+	a.sum += s.sum
+	a.min = math.Min(a.min, s.min)
+	a.max = math.Max(a.max, s.max)
+	a.last = last
+}
+
+func (a *accumulator) bucket(start time.Time, fn Aggregation) Bucket {
+	b := Bucket{Start: start, Count: a.count}
+
+	switch fn.Func {
+	case AGGREGATE_COUNT:
+		b.Value = float64(a.count)
+	case AGGREGATE_SUM:
+		b.Value = a.sum
+	case AGGREGATE_MIN:
+		b.Value = a.min
+	case AGGREGATE_MAX:
+		b.Value = a.max
+	case AGGREGATE_MEAN:
+		b.Value = a.sum / float64(a.count)
+	case AGGREGATE_FIRST:
+		b.Value = a.first
+	case AGGREGATE_LAST:
+		b.Value = a.last
+	case AGGREGATE_STDDEV:
+		b.Value = math.Sqrt(a.m2 / float64(a.count))
+	case AGGREGATE_PERCENTILE:
+		b.Value = percentile(a.values, fn.Percentile)
+	}
+
+	return b
+}
+
+// percentile finds the pth percentile of some values, interpolating between
+// the two nearest to it. the values are sorted in place.
+func percentile(values []float64, p float64) float64 {
+	sort.Float64s(values)
+
+	rank := p / 100 * float64(len(values)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+
+	return values[lo] + (values[hi]-values[lo])*(rank-float64(lo))
+}
@@ -0,0 +1,168 @@
+package jikan
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type demoPoint struct {
+	t time.Time
+	v int64
+}
+
+func readDemo(b *testing.B) []demoPoint {
+	f, err := os.Open("../demo/demo.csv")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	points := make([]demoPoint, len(records))
+	for i, record := range records {
+		if points[i].t, err = time.Parse(time.RFC3339Nano, record[0]); err != nil {
+			b.Fatal(err)
+		}
+
+		if points[i].v, err = strconv.ParseInt(record[1], 10, 64); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return points
+}
+
+// benchmarkDemo imports demo/demo.csv into a stream with the given options,
+// and reports how many bytes of block data each point takes up.
+func benchmarkDemo(b *testing.B, options StreamOptions) {
+	defer os.Remove("test.db")
+
+	points := readDemo(b)
+
+	var used, count uint64
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		os.Remove("test.db")
+
+		db, err := Open("test.db")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		s, err := db.StreamWithOptions(s1, options)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		err = s.WithTx(func(tx *StreamTx) error {
+			for _, p := range points {
+				if err := tx.Add(p.t, p.v); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		used, count = 0, s.Count()
+		for _, blk := range s.chain {
+			used += uint64(blk.used)
+		}
+
+		if err := db.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportMetric(float64(used)/float64(count), "bytes/point")
+}
+
+func BenchmarkDemoRLE(b *testing.B) {
+	benchmarkDemo(b, StreamOptions{Codec: CODEC_RLE})
+}
+
+func BenchmarkDemoVarint(b *testing.B) {
+	benchmarkDemo(b, StreamOptions{Codec: CODEC_VARINT})
+}
+
+func BenchmarkDemoGorilla(b *testing.B) {
+	benchmarkDemo(b, StreamOptions{Codec: CODEC_GORILLA})
+}
+
+func BenchmarkDemoRLESeconds(b *testing.B) {
+	benchmarkDemo(b, StreamOptions{Codec: CODEC_RLE, Precision: PRECISION_SECOND})
+}
+
+func BenchmarkDemoVarintSeconds(b *testing.B) {
+	benchmarkDemo(b, StreamOptions{Codec: CODEC_VARINT, Precision: PRECISION_SECOND})
+}
+
+func BenchmarkDemoGorillaSeconds(b *testing.B) {
+	benchmarkDemo(b, StreamOptions{Codec: CODEC_GORILLA, Precision: PRECISION_SECOND})
+}
+
+// benchmarkAggregate imports demo/demo.csv once, and then aggregates all of it
+// into a single bucket with fn.
+func benchmarkAggregate(b *testing.B, fn AggregateFunc) {
+	defer os.Remove("test.db")
+
+	os.Remove("test.db")
+
+	points := readDemo(b)
+
+	db, err := Open("test.db")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = s.WithTx(func(tx *StreamTx) error {
+		for _, p := range points {
+			if err := tx.Add(p.t, p.v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		if _, err := s.Aggregate(time.Time{}, time.Time{}, 0, Aggregation{Func: fn}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// sums come from the block summaries, and standard deviations have to decode
+// every point
+func BenchmarkAggregateSum(b *testing.B) {
+	benchmarkAggregate(b, AGGREGATE_SUM)
+}
+
+func BenchmarkAggregateStddev(b *testing.B) {
+	benchmarkAggregate(b, AGGREGATE_STDDEV)
+}
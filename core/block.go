@@ -3,6 +3,8 @@ package jikan
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
+	"math"
 	"sync"
 	"time"
 
@@ -10,25 +12,101 @@ import (
 	"github.com/facebookgo/stackerr"
 )
 
+// a block is laid out on disk like so:
+//
+//   0   length of the data area
+//   4   current header page
+//   5   header pages (see readHeader)
+//   77  time and value of the first point
+//   93  time precision
+//   94  type of the first field
+//   95  codec
+//   96  number of other fields
+//   97  types of the other fields, one bit each, set for floats
+//   101 summary pages (see readHeader)
+//   149 data area
+//
+// before format version 3, there was no precision, value type or codec, and
+// blocks always held run-length encoded integers with times in microseconds.
+// the data area started at 93. the bytes at 96 were zeroed in version 3, so
+// blocks from then have a single field. there were no summary pages before
+// version 6, so the data area started at 101. blocks from before format
+// version 2 have a different header layout, which is described in
+// readLegacyHeader.
 type block struct {
 	sync.Mutex
 
 	db       *Database
 	position uint64
 
-	length uint32
-	page   uint8
+	length    uint32
+	page      uint8
+	precision Precision
+	types     []ValueType
+	codecID   CodecID
+	codec     Codec
 
-	used  uint32
-	next  uint64
-	time  time.Time
-	value int64
+	blockState
+}
+
+// blockState is the mutable, in-memory state of a block. it's kept separately
+// so that transactions can take a copy of it and restore it on rollback.
+type blockState struct {
+	used uint32
+	next uint64
+	time time.Time
+
+	// values holds the last value of each field. only the first is kept in the
+	// header, and the rest are worked out again when the block is resumed.
+	values [MAXIMUM_FIELDS]int64
+
+	// count is the number of points in the block, and startTime/startValue are
+	// the time and first field of the first of them. these let us find the
+	// right block for a given time without decoding anything.
+	count      uint32
+	startTime  time.Time
+	startValue int64
+
+	// summary is the minimum, maximum and sum of the first field of every
+	// point in the block, which lets aggregations skip decoding it.
+	summary blockSummary
+
+	// synced is the value of used as of the last header write. records before
+	// this point are visible to readers and must never be rewritten.
+	synced uint32
+
+	// state is the codec's state for appending to the block. it's not kept in
+	// the header, so resumed is false until it's been worked out again after
+	// the block is read, along with the values.
+	state   CodecState
+	resumed bool
+}
+
+// blockSummary holds values as floats, whatever the type of the field, since
+// that's how they're aggregated.
+type blockSummary struct {
+	min float64
+	max float64
+	sum float64
 }
 
 var (
 	ERR_BLOCK_FULL = errors.New("no space left")
 )
 
+// blockHeaderLength returns the length of a block header in the given format
+// version.
+func blockHeaderLength(version uint16) uint64 {
+	switch {
+	case version < 3:
+		return 93
+	case version < 6:
+		return 101
+	}
+
+	return 101 + 2*BLOCK_SUMMARY_LENGTH
+}
+
 func newBlock(db *Database, position uint64) (*block, error) {
 	log.Debugf("constructing new block at %d\n", position)
 
@@ -37,21 +115,110 @@ func newBlock(db *Database, position uint64) (*block, error) {
 		position: position,
 	}
 
+	header := blockHeaderLength(db.version)
+
+	if position+header > uint64(len(db.mm)) {
+		return nil, &CorruptionError{Position: position, What: "block position"}
+	}
+
 	length := binary.BigEndian.Uint32(db.mm[position : position+4])
 	page := db.mm[position+4]
 
+	if position+header+uint64(length) > uint64(len(db.mm)) {
+		return nil, &CorruptionError{Position: position, What: "block length"}
+	}
+
+	if page > 1 {
+		return nil, &CorruptionError{Position: position, What: "block header page"}
+	}
+
+	// if the current header page is damaged, the other one still has the state
+	// as of the previous write, which is better than nothing
 	if err := b.readHeader(page); err != nil {
-		return nil, stackerr.Wrap(err)
+		if _, ok := err.(*CorruptionError); !ok {
+			return nil, stackerr.Wrap(err)
+		}
+
+		log.Debugf("block header page %d is corrupt, trying page %d\n", page, page^1)
+
+		if b.readHeader(page^1) != nil {
+			return nil, err
+		}
+
+		page ^= 1
 	}
 
 	b.length = length
 	b.page = page
+	b.precision = PRECISION_MICROSECOND
+	b.types = []ValueType{TYPE_INT64}
+	b.codecID = CODEC_RLE
+
+	if db.version >= 3 {
+		b.precision = Precision(db.mm[position+93])
+		b.codecID = CodecID(db.mm[position+95])
 
-	log.Debugf("length %d, page %d\n", length, page)
+		others := int(db.mm[position+96])
+		if others >= MAXIMUM_FIELDS {
+			return nil, &CorruptionError{Position: position, What: "block field count"}
+		}
+
+		floats := binary.BigEndian.Uint32(db.mm[position+97 : position+101])
+
+		b.types = make([]ValueType, 1+others)
+		b.types[0] = ValueType(db.mm[position+94])
+
+		for i := 1; i <= others; i++ {
+			if floats>>uint(i-1)&1 == 1 {
+				b.types[i] = TYPE_FLOAT64
+			}
+		}
+	}
+
+	log.Debugf("length %d, page %d, precision %s, types %v, codec %s\n", length, page, b.precision, b.types, b.codecID)
+
+	if !b.precision.valid() {
+		return nil, &CorruptionError{Position: position, What: "block precision"}
+	}
+
+	if !b.types[0].valid() {
+		return nil, &CorruptionError{Position: position, What: "block value type"}
+	}
+
+	if !b.codecID.valid() {
+		return nil, &CorruptionError{Position: position, What: "block codec"}
+	}
+
+	b.codec = codecs[b.codecID]
+
+	if b.used > b.length {
+		return nil, &CorruptionError{Position: position, What: "block used length"}
+	}
+
+	// blocks written before the point count was kept in the header will have a
+	// count of zero despite having data in them
+	if b.count == 0 && b.used != 0 {
+		if err := b.scan(); err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+	}
 
 	return &b, nil
 }
 
+// size returns the amount of space that the block takes up, including its
+// header.
+func (b *block) size() uint64 {
+	return blockHeaderLength(b.db.version) + uint64(b.length)
+}
+
+// data returns the block's data area.
+func (b *block) data() []byte {
+	o := b.position + blockHeaderLength(b.db.version)
+
+	return b.db.mm[o : o+uint64(b.length)]
+}
+
 func (b *block) tx(fn func() error) error {
 	b.Lock()
 	defer b.Unlock()
@@ -81,41 +248,318 @@ func (b *block) writeAndSwapHeader() error {
 
 	b.page ^= 1
 	b.db.mm[int(b.position)+4] = b.page
+	b.synced = b.used
 
 	log.Debugf("after swap: %d/%d\n", b.page, b.db.mm[int(b.position)+4])
 
 	return b.db.mm.Flush()
 }
 
-func (b *block) add(t time.Time, v int64) error {
+func (b *block) add(t time.Time, vs []int64) error {
+	if len(vs) != len(b.types) {
+		return ERR_WRONG_FIELD_COUNT
+	}
+
+	if b.count > 0 && !b.resumed {
+		if err := b.resume(); err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+
+	unit := b.precision.Duration()
+
+	// truncating here, rather than just the delta, keeps the time that the next
+	// delta is taken from in step with what's actually stored
+	t = t.Truncate(unit)
+
 	td := t.Sub(b.time)
-	vd := v - b.value
 
-	log.Debugf("time delta %d, value delta %d\n", td, vd)
+	var vd [MAXIMUM_FIELDS]int64
+	for i, typ := range b.types {
+		vd[i] = typ.delta(b.values[i], vs[i])
+	}
+
+	log.Debugf("time delta %d, value deltas %v\n", td, vd[:len(vs)])
 
 	if td < 0 {
 		return stackerr.New("datapoint violates time ordering")
 	}
 
-	u := 0
-	var buf [32]byte
-	u += binary.PutVarint(buf[u:], int64(td)/1000)
-	u += binary.PutVarint(buf[u:], vd)
+	tdelta := int64(td / unit)
 
-	if int(b.used)+u >= int(b.length) {
-		return ERR_BLOCK_FULL
+	d := b.blockData()
+	if err := b.codec.Append(d, tdelta, vd[:len(vs)]); err != nil {
+		return err
 	}
 
-	copy(b.db.mm[int(b.position)+93+int(b.used):int(b.position)+93+int(b.used)+u], buf[0:u])
-	b.used += uint32(u)
+	b.used = d.Used
+	b.state = d.State
+	b.resumed = true
+
+	f := b.types[0].float(vs[0])
+
+	if b.count == 0 {
+		b.startTime = time.Unix(0, 0).Add(time.Duration(tdelta) * unit)
+		b.startValue = vs[0]
+		b.summary = blockSummary{min: f, max: f}
+	}
+
+	b.summary.min = math.Min(b.summary.min, f)
+	b.summary.max = math.Max(b.summary.max, f)
+	b.summary.sum += f
+
+	b.count++
 
 	b.time = t
-	b.value = v
+	copy(b.values[:], vs)
+
+	return nil
+}
+
+// resume works out the state that isn't kept in the header of a block that's
+// been read back from disk: the codec's, and the last value of every field
+// after the first, which means decoding the whole block.
+func (b *block) resume() error {
+	log.Debugf("resuming block at %d\n", b.position)
+
+	if len(b.types) > 1 {
+		err := b.points(func(t time.Time, vs []int64) error {
+			copy(b.values[:], vs)
+
+			return nil
+		})
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+
+	d := b.blockData()
+	if err := b.codec.Resume(d); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	b.state = d.State
+	b.resumed = true
 
 	return nil
 }
 
+// scan decodes every record in the block to work out the point count and the
+// first point.
+func (b *block) scan() error {
+	log.Debugf("scanning block at %d\n", b.position)
+
+	b.count = 0
+
+	return b.records(func(count uint32, tdelta int64, vdeltas []int64) error {
+		if b.count == 0 {
+			b.startTime = time.Unix(0, 0).Add(time.Duration(tdelta) * b.precision.Duration())
+			b.startValue = b.types[0].apply(0, vdeltas[0])
+		}
+
+		b.count += count
+
+		return nil
+	})
+}
+
+// summarize works out the block's summary from its points, for checking the
+// one in its header.
+func (b *block) summarize() (blockSummary, error) {
+	var s blockSummary
+	var n uint32
+
+	err := b.points(func(t time.Time, vs []int64) error {
+		f := b.types[0].float(vs[0])
+
+		if n == 0 {
+			s = blockSummary{min: f, max: f}
+		}
+
+		s.min = math.Min(s.min, f)
+		s.max = math.Max(s.max, f)
+		s.sum += f
+		n++
+
+		return nil
+	})
+
+	return s, err
+}
+
+// equal reports whether two summaries are exactly the same, down to the bits
+// of any NaNs.
+func (s blockSummary) equal(o blockSummary) bool {
+	return math.Float64bits(s.min) == math.Float64bits(o.min) &&
+		math.Float64bits(s.max) == math.Float64bits(o.max) &&
+		math.Float64bits(s.sum) == math.Float64bits(o.sum)
+}
+
+// records decodes every record in the used part of the block, in order. the
+// slice of value deltas is reused from one record to the next.
+func (b *block) records(fn func(count uint32, tdelta int64, vdeltas []int64) error) error {
+	if b.used > b.length {
+		return &CorruptionError{Position: b.position, What: "block used length"}
+	}
+
+	vdeltas := make([]int64, len(b.types))
+
+	for r := b.reader(); r.more(); {
+		count, tdelta, err := r.next(vdeltas)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(count, tdelta, vdeltas); err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// points decodes every point in the block, in order, passing the value of each
+// field in a slice that's reused from one point to the next. a run that would
+// take the block past the point count in its header is treated as corrupt,
+// since a damaged count could otherwise go on for billions of points.
+func (b *block) points(fn func(t time.Time, vs []int64) error) error {
+	var seen uint32
+	var t time.Time
+
+	vs := make([]int64, len(b.types))
+
+	unit := b.precision.Duration()
+
+	return b.records(func(count uint32, tdelta int64, vdeltas []int64) error {
+		if count > b.count-seen {
+			return &CorruptionError{Position: b.position, What: "record run length"}
+		}
+
+		for i := uint32(0); i < count; i++ {
+			if seen == 0 {
+				t = time.Unix(0, 0)
+			}
+
+			t = t.Add(time.Duration(tdelta) * unit)
+			for k, typ := range b.types {
+				vs[k] = typ.apply(vs[k], vdeltas[k])
+			}
+			seen++
+
+			if err := fn(t, vs); err != nil {
+				return stackerr.Wrap(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// blockData returns the part of the block that its codec works with.
+func (b *block) blockData() *BlockData {
+	return &BlockData{
+		Data:   b.data(),
+		Used:   b.used,
+		Synced: b.synced,
+		Count:  b.count,
+		Types:  b.types,
+		State:  b.state,
+	}
+}
+
+// blockReader wraps a block's decoder, turning its errors into corruption
+// errors that say where the bad record is.
+type blockReader struct {
+	b *block
+	d Decoder
+}
+
+func (b *block) reader() *blockReader {
+	return &blockReader{b: b, d: b.codec.Decoder(b.blockData())}
+}
+
+func (r *blockReader) more() bool {
+	return r.d.More()
+}
+
+func (r *blockReader) next(vdeltas []int64) (count uint32, tdelta int64, err error) {
+	o := r.d.Offset()
+
+	// every record holds at least one point, whatever the codec, and a run
+	// count of zero would wrap around in the iterator
+	count, tdelta, err = r.d.Next(vdeltas)
+	if err != nil || count == 0 {
+		return 0, 0, &CorruptionError{Position: r.b.position + blockHeaderLength(r.b.db.version) + o, What: "record"}
+	}
+
+	return count, tdelta, nil
+}
+
+// each header page holds the used length, next block position, last time and
+// value of the first field, point count and a checksum. the checksum also
+// covers the length of the block and the first point, which are written only
+// once, and the summary page that goes with the header page.
+const BLOCK_PAGE_LENGTH = 36
+
+// each summary page holds the minimum, maximum and sum of the first field, as
+// the bits of floats.
+const BLOCK_SUMMARY_LENGTH = 24
+
 func (b *block) readHeader(page uint8) error {
+	if b.db.version < 2 {
+		return b.readLegacyHeader(page)
+	}
+
+	o := int(b.position) + 5 + int(page)*BLOCK_PAGE_LENGTH
+
+	log.Debugf("reading block header from page %d (offset %d/0x%x)\n", page, o, o)
+
+	d := b.db.mm[o : o+BLOCK_PAGE_LENGTH]
+
+	if binary.BigEndian.Uint32(d[32:36]) != b.checksum(page) {
+		return &CorruptionError{Position: uint64(o), What: "block header"}
+	}
+
+	b.used = binary.BigEndian.Uint32(d[0:4])
+	b.next = binary.BigEndian.Uint64(d[4:12])
+	b.time = time.Unix(0, int64(binary.BigEndian.Uint64(d[12:20])))
+	b.values = [MAXIMUM_FIELDS]int64{int64(binary.BigEndian.Uint64(d[20:28]))}
+	b.count = binary.BigEndian.Uint32(d[28:32])
+	b.synced = b.used
+	b.state = CodecState{}
+	b.resumed = false
+
+	if b.count != 0 {
+		b.startTime = time.Unix(0, int64(binary.BigEndian.Uint64(b.db.mm[int(b.position)+77:int(b.position)+85])))
+		b.startValue = int64(binary.BigEndian.Uint64(b.db.mm[int(b.position)+85 : int(b.position)+93]))
+	}
+
+	b.summary = blockSummary{}
+
+	if b.summarized() {
+		s := b.db.mm[int(b.position)+101+int(page)*BLOCK_SUMMARY_LENGTH:]
+
+		b.summary.min = math.Float64frombits(binary.BigEndian.Uint64(s[0:8]))
+		b.summary.max = math.Float64frombits(binary.BigEndian.Uint64(s[8:16]))
+		b.summary.sum = math.Float64frombits(binary.BigEndian.Uint64(s[16:24]))
+	}
+
+	log.Debugf("used %d, next %d, time %s, value %d, count %d\n", b.used, b.next, b.time, b.values[0], b.count)
+
+	return nil
+}
+
+// summarized reports whether the block keeps a summary of its points, which
+// blocks from before format version 6 don't.
+func (b *block) summarized() bool {
+	return b.db.version >= 6
+}
+
+// readLegacyHeader reads a header from a block written before format version 2.
+// in these blocks, the header pages start at 5 and overlap, so only the current
+// one is intact. the first point is kept at 61, and the point count for each
+// page at 77.
+func (b *block) readLegacyHeader(page uint8) error {
 	o := int(b.position) + 5 + int(page*12)
 
 	log.Debugf("reading block header from page %d (offset %d/0x%x)\n", page, o, o)
@@ -127,27 +571,81 @@ func (b *block) readHeader(page uint8) error {
 
 	b.used = binary.BigEndian.Uint32(d[0:4])
 	b.next = binary.BigEndian.Uint64(d[4:12])
-	b.time = time.Unix(int64(t)/int64(time.Millisecond), int64(t)%int64(time.Millisecond))
-	b.value = v
+	b.time = time.Unix(0, int64(t))
+	b.values = [MAXIMUM_FIELDS]int64{v}
+	b.synced = b.used
+	b.state = CodecState{}
+	b.resumed = false
+
+	// the point count is kept per page, just past the end of the second page.
+	// the first point is only written once, so it doesn't need two copies.
+	b.count = binary.BigEndian.Uint32(b.db.mm[int(b.position)+77+int(page)*4 : int(b.position)+81+int(page)*4])
+	if b.count != 0 {
+		b.startTime = time.Unix(0, int64(binary.BigEndian.Uint64(b.db.mm[int(b.position)+61:int(b.position)+69])))
+		b.startValue = int64(binary.BigEndian.Uint64(b.db.mm[int(b.position)+69 : int(b.position)+77]))
+	}
 
-	log.Debugf("used %d, next %d, time %s, value %d\n", b.used, b.next, b.time, b.value)
+	log.Debugf("used %d, next %d, time %s, value %d, count %d\n", b.used, b.next, b.time, b.values[0], b.count)
 
 	return nil
 }
 
 func (b *block) writeHeader(page uint8) error {
-	o := int(b.position) + 5 + int(page*12)
+	o := int(b.position) + 5 + int(page)*BLOCK_PAGE_LENGTH
 
 	log.Debugf("writing block header to page %d (offset %d/0x%x)\n", page, o, o)
 
-	d := b.db.mm[o : o+44]
+	d := b.db.mm[o : o+BLOCK_PAGE_LENGTH]
 
 	binary.BigEndian.PutUint32(d[0:4], b.used)
 	binary.BigEndian.PutUint64(d[4:12], b.next)
-	binary.PutUvarint(d[12:28], uint64(b.time.UnixNano()))
-	binary.PutVarint(d[28:44], b.value)
+	binary.BigEndian.PutUint64(d[12:20], uint64(b.time.UnixNano()))
+	binary.BigEndian.PutUint64(d[20:28], uint64(b.values[0]))
+	binary.BigEndian.PutUint32(d[28:32], b.count)
 
-	log.Debugf("used %d, next %d, time %s, value %d\n", b.used, b.next, b.time, b.value)
+	if b.count != 0 {
+		binary.BigEndian.PutUint64(b.db.mm[int(b.position)+77:int(b.position)+85], uint64(b.startTime.UnixNano()))
+		binary.BigEndian.PutUint64(b.db.mm[int(b.position)+85:int(b.position)+93], uint64(b.startValue))
+	}
+
+	if b.summarized() {
+		s := b.db.mm[int(b.position)+101+int(page)*BLOCK_SUMMARY_LENGTH:]
+
+		binary.BigEndian.PutUint64(s[0:8], math.Float64bits(b.summary.min))
+		binary.BigEndian.PutUint64(s[8:16], math.Float64bits(b.summary.max))
+		binary.BigEndian.PutUint64(s[16:24], math.Float64bits(b.summary.sum))
+	}
+
+	binary.BigEndian.PutUint32(d[32:36], b.checksum(page))
+
+	log.Debugf("used %d, next %d, time %s, value %d, count %d\n", b.used, b.next, b.time, b.values[0], b.count)
 
 	return nil
 }
+
+// checksum calculates the checksum for a header page. the first point is only
+// covered once the page says there's a point in the block, otherwise writing
+// the first point would invalidate the other page. the precision, codec and
+// field types are written when the block is created, so they're always
+// covered.
+func (b *block) checksum(page uint8) uint32 {
+	o := int(b.position) + 5 + int(page)*BLOCK_PAGE_LENGTH
+
+	c := crc32.Update(0, CRC_TABLE, b.db.mm[int(b.position):int(b.position)+4])
+	c = crc32.Update(c, CRC_TABLE, b.db.mm[o:o+BLOCK_PAGE_LENGTH-4])
+
+	if binary.BigEndian.Uint32(b.db.mm[o+28:o+32]) != 0 {
+		c = crc32.Update(c, CRC_TABLE, b.db.mm[int(b.position)+77:int(b.position)+93])
+	}
+
+	if b.db.version >= 3 {
+		c = crc32.Update(c, CRC_TABLE, b.db.mm[int(b.position)+93:int(b.position)+101])
+	}
+
+	if b.summarized() {
+		s := int(b.position) + 101 + int(page)*BLOCK_SUMMARY_LENGTH
+		c = crc32.Update(c, CRC_TABLE, b.db.mm[s:s+BLOCK_SUMMARY_LENGTH])
+	}
+
+	return c
+}
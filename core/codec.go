@@ -0,0 +1,140 @@
+package jikan
+
+import (
+	"errors"
+)
+
+// A Codec encodes points into the data area of a block, and decodes them again.
+// Each block records the ID of the codec that it was written with, so streams
+// using different codecs can live in the same file, and a reader only needs to
+// know the ID to decode any block.
+//
+// Points are given to a codec as deltas: the time delta is in units of the
+// stream's precision, and there's a value delta for each of the stream's
+// fields, in whatever form the field's type uses (see ValueType). The first
+// point in a block is relative to the unix epoch and values of zero.
+type Codec interface {
+	// Name is the name that the codec is chosen by, as in ParseCodec.
+	Name() string
+
+	// Append adds a point to the end of the block, updating Used and State. If
+	// it doesn't fit, it returns ERR_BLOCK_FULL and leaves the block alone.
+	Append(b *BlockData, tdelta int64, vdeltas []int64) error
+
+	// Resume works out State for a block that's been read back from disk, so
+	// that Append can carry on where it left off.
+	Resume(b *BlockData) error
+
+	// Decoder returns a Decoder for the points in a block.
+	Decoder(b *BlockData) Decoder
+}
+
+// A Decoder reads the points in a block one record at a time.
+type Decoder interface {
+	// More reports whether there are any records left.
+	More() bool
+
+	// Next decodes the next record, which is count points that all have the
+	// same time and value deltas. The value deltas are written to vdeltas,
+	// which has room for one per field.
+	Next(vdeltas []int64) (count uint32, tdelta int64, err error)
+
+	// Offset returns the offset in the data area of the next record, for error
+	// reporting.
+	Offset() uint64
+}
+
+// BlockData is the part of a block that a codec works with.
+type BlockData struct {
+	// Data is the whole of the data area, and the first Used bytes of it hold
+	// Count points. Synced is the part of the data that readers can already
+	// see, which Append mustn't change, though it's free to fill in unused
+	// bits at the end of it.
+	Data   []byte
+	Used   uint32
+	Synced uint32
+	Count  uint32
+
+	// Types holds the type of each field.
+	Types []ValueType
+	State CodecState
+}
+
+// CodecState is what a codec remembers between points while it's appending to
+// a block. It's kept with the rest of the block's state in memory, so it's
+// rolled back along with everything else when a transaction is cancelled. It's
+// all zero in a new block. The fields mean whatever the codec wants them to.
+type CodecState struct {
+	Offset  uint64
+	Count   uint32
+	TDelta  int64
+	VDeltas [MAXIMUM_FIELDS]int64
+}
+
+// CodecID identifies a codec in block headers.
+type CodecID uint8
+
+const (
+	// CODEC_RLE stores varint time and value deltas, collapsing runs of
+	// repeated deltas into a single record. it's the default, and the only
+	// encoding used before codecs could be chosen.
+	CODEC_RLE CodecID = 0
+
+	// CODEC_GORILLA packs the difference between successive time deltas into
+	// as few bits as possible, as in Facebook's Gorilla.
+	CODEC_GORILLA CodecID = 1
+
+	// CODEC_VARINT stores varint time and value deltas, one point per record.
+	CODEC_VARINT CodecID = 2
+)
+
+var (
+	ERR_BAD_CODEC    = errors.New("unknown codec")
+	ERR_CODEC_EXISTS = errors.New("a codec with that ID or name already exists")
+)
+
+var codecs = map[CodecID]Codec{
+	CODEC_RLE:     rleCodec{},
+	CODEC_GORILLA: gorillaCodec{},
+	CODEC_VARINT:  varintCodec{},
+}
+
+// RegisterCodec makes a codec available under the given ID. IDs are stored in
+// files, so a codec has to be registered under the same ID whenever a file
+// that uses it is opened.
+func RegisterCodec(id CodecID, c Codec) error {
+	for i, o := range codecs {
+		if i == id || o.Name() == c.Name() {
+			return ERR_CODEC_EXISTS
+		}
+	}
+
+	codecs[id] = c
+
+	return nil
+}
+
+// ParseCodec finds a codec by name.
+func ParseCodec(s string) (CodecID, error) {
+	for id, c := range codecs {
+		if c.Name() == s {
+			return id, nil
+		}
+	}
+
+	return 0, ERR_BAD_CODEC
+}
+
+func (id CodecID) String() string {
+	if c, ok := codecs[id]; ok {
+		return c.Name()
+	}
+
+	return "unknown"
+}
+
+func (id CodecID) valid() bool {
+	_, ok := codecs[id]
+
+	return ok
+}
@@ -0,0 +1,156 @@
+package jikan
+
+import (
+	"encoding/binary"
+	"os"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// Compact writes a copy of the database to a new file. Each stream is written
+// into a single block that's just big enough to hold its data, and the index is
+// written once, at the end, so the new file has no unused space in it. It
+// returns the number of bytes saved.
+func (db *Database) Compact(filename string) (int64, error) {
+	log.Debugf("compacting database to `%s'\n", filename)
+
+	if _, err := os.Stat(filename); err == nil {
+		return 0, stackerr.Newf("destination `%s' already exists", filename)
+	} else if !os.IsNotExist(err) {
+		return 0, stackerr.Wrap(err)
+	}
+
+	dst, err := Open(filename)
+	if err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+
+	for _, name := range db.Streams() {
+		src, err := db.LookupStream(name)
+		if err != nil {
+			dst.Close()
+			return 0, stackerr.Wrap(err)
+		}
+
+		if err := dst.compactStream(src); err != nil {
+			dst.Close()
+			return 0, stackerr.Wrap(err)
+		}
+	}
+
+	// the index hasn't been written at all yet, so this puts it right at the end
+	// of the file, after all the blocks
+	if err := dst.writeAndSwapHeader(); err != nil {
+		dst.Close()
+		return 0, stackerr.Wrap(err)
+	}
+
+	used := dst.used
+
+	if err := dst.Close(); err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+
+	if err := os.Truncate(filename, int64(used)); err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+
+	saved := int64(len(db.mm)) - int64(used)
+
+	log.Debugf("compacted %d bytes to %d\n", len(db.mm), used)
+
+	return saved, nil
+}
+
+// compactStream copies all the points from src into a new stream. nothing is
+// written to the database header, so this is only safe to use on a database
+// that nobody else can see yet.
+func (db *Database) compactStream(src *Stream) error {
+	log.Debugf("compacting stream `%s'\n", src.id)
+
+	// the first point in each block is stored relative to zero, and the rest
+	// relative to the point before, so the points can take more or less space
+	// once they're merged into one block: a float that's relative to the one
+	// before can't always be stored in fewer bytes. every join is given space
+	// for a whole record, and every late point and update for its own record
+	// and the one after it, which is enough for everything. space that isn't
+	// used is trimmed off below.
+	var size uint32
+	for _, b := range src.chain {
+		size += b.used + MAXIMUM_RECORD_LENGTH
+	}
+
+	size += uint32(len(src.late)+len(replacements(src.tombstones))) * 2 * MAXIMUM_RECORD_LENGTH
+
+	root, err := db.newBlock(size+1, src.Options())
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	// the properties of the stream are copied as they are, whether or not
+	// they're understood, except for its late points, which are merged in with
+	// the rest, and its tombstones, since the points that they cover are left
+	// out
+	r := &dbRoot{
+		id:         src.id,
+		position:   root.position,
+		properties: src.db.root(src.id).properties,
+	}
+
+	var late []byte
+	if src.outOfOrder {
+		late = encodeLate(true, nil)
+	}
+
+	r.setProperty(PROPERTY_LATE, late)
+	r.setProperty(PROPERTY_TOMBSTONES, nil)
+
+	db.addRoot(r)
+
+	s, err := db.Stream(src.id)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	// the points are copied as the iterator returns them, so the duplicate
+	// policy has already been applied. applying it again would refuse or drop
+	// points at the same time that were added before the policy was set.
+	s.duplicates = DUPLICATES_KEEP_ALL
+
+	// the transaction doesn't update the stream's rollups, since the streams
+	// that they're kept in are copied as they are, or apply its retention, which
+	// can't drop the only block
+	tx := s.Tx()
+
+	for it := src.Iterator(); it.Good(); it.Next() {
+		if err := tx.add(it.Time, it.raws); err != nil {
+			tx.Cancel()
+			return stackerr.Wrap(err)
+		}
+	}
+
+	err = tx.commit()
+	s.duplicates = src.duplicates
+	s.Unlock()
+
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	// if the last block is also the last thing in the file, it can be trimmed
+	// down to exactly the space that it's using. the length is covered by the
+	// header checksum, so the header has to be written again too.
+	if b := s.head; b.position+b.size() == db.used {
+		b.length = b.used + 1
+		binary.BigEndian.PutUint32(db.mm[b.position:b.position+4], b.length)
+
+		db.used = b.position + b.size()
+
+		if err := b.writeAndSwapHeader(); err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+
+	return nil
+}
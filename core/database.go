@@ -3,7 +3,10 @@ package jikan
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/demizer/go-elog"
@@ -11,11 +14,115 @@ import (
 	"github.com/facebookgo/stackerr"
 )
 
-const MINIMUM_HEADER_LENGTH = 33
+// indexes written since the free list was introduced have this bit set in
+// their root count. they also record their own length, and the roots are
+// followed by the free list.
+const INDEX_EXTENDED = 1 << 31
+
+var (
+	ERR_STREAM_NOT_FOUND        = errors.New("stream not found")
+	ERR_STREAM_OPTIONS_MISMATCH = errors.New("stream already exists with different options")
+)
 
 type dbRoot struct {
-	id       []byte
+	id         []byte
+	position   uint64
+	properties []dbProperty
+}
+
+// dbProperty is a piece of information about a stream that's kept with its
+// root in the index, identified by a tag. properties with tags that aren't
+// known are kept as they are.
+type dbProperty struct {
+	tag  uint8
+	data []byte
+}
+
+const (
+	// PROPERTY_SCHEMA holds the fields of a stream (see encodeSchema). it's
+	// only set for streams that were created with them.
+	PROPERTY_SCHEMA = 1
+
+	// PROPERTY_METADATA holds the labels, unit and description of a stream (see
+	// encodeMetadata), if it has any.
+	PROPERTY_METADATA = 2
+
+	// PROPERTY_ROLLUPS holds the rollups that are kept from a stream (see
+	// encodeRollups), if there are any.
+	PROPERTY_ROLLUPS = 3
+
+	// PROPERTY_RETENTION holds the limits on how much of a stream is kept (see
+	// encodeRetention), if it has any.
+	PROPERTY_RETENTION = 4
+
+	// PROPERTY_LATE holds the points that were added to a stream out of order
+	// (see encodeLate), if it takes them or has any.
+	PROPERTY_LATE = 5
+
+	// PROPERTY_DUPLICATES holds what a stream does with points at the same time
+	// as one that it already has, unless it keeps them all.
+	PROPERTY_DUPLICATES = 6
+
+	// PROPERTY_TOMBSTONES holds the points that have been deleted or updated in
+	// a stream (see encodeTombstones), if there are any.
+	PROPERTY_TOMBSTONES = 7
+)
+
+// property returns the data of the property with the given tag, or nil if the
+// root doesn't have one. the root of a stream that's been deleted is nil, and
+// has no properties.
+func (r *dbRoot) property(tag uint8) []byte {
+	if r == nil {
+		return nil
+	}
+
+	for _, p := range r.properties {
+		if p.tag == tag {
+			return p.data
+		}
+	}
+
+	return nil
+}
+
+// setProperty replaces the property with the given tag, or removes it if data
+// is nil.
+func (r *dbRoot) setProperty(tag uint8, data []byte) {
+	properties := make([]dbProperty, 0, len(r.properties)+1)
+
+	for _, p := range r.properties {
+		if p.tag != tag {
+			properties = append(properties, p)
+		}
+	}
+
+	if data != nil {
+		properties = append(properties, dbProperty{tag: tag, data: data})
+	}
+
+	r.properties = properties
+}
+
+// length returns the space that the root takes up in the index, in the given
+// format version.
+func (r *dbRoot) length(version uint16) int {
+	n := 2 + len(r.id) + 8
+
+	if version >= 4 {
+		n += 2
+		for _, p := range r.properties {
+			n += 1 + 4 + len(p.data)
+		}
+	}
+
+	return n
+}
+
+// dbFree is a region of the file that's not in use by anything, and can be
+// handed out again by allocate.
+type dbFree struct {
 	position uint64
+	length   uint64
 }
 
 type dbStream struct {
@@ -30,15 +137,66 @@ type Database struct {
 	fd       *os.File
 	mm       mmap.MMap
 
-	page  uint8
-	index uint64
-	used  uint64
+	// version is the format version of the file, and base is the offset of the
+	// header, just past the signature
+	version uint16
+	base    uint64
+
+	page        uint8
+	index       uint64
+	indexLength uint64
+	used        uint64
 
 	roots   []*dbRoot
 	streams []*dbStream
+
+	// labels indexes the streams by the labels in their metadata
+	labels dbLabels
+
+	// free is the list of regions that can be reused, sorted by position.
+	// released holds regions that have been given up since the last header
+	// write, which may still be referenced by the current header. pending holds
+	// those given up before that, which are only referenced by the other header
+	// page. they're kept intact so that page can be fallen back to if the
+	// current one turns out to be corrupt.
+	free     []*dbFree
+	pending  []*dbFree
+	released []*dbFree
 }
 
 func Open(filename string) (*Database, error) {
+	db, err := open(filename, FORMAT_VERSION)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	switch {
+	case db.version == 0:
+		db.close()
+		return nil, ERR_BAD_SIGNATURE
+	case db.version < FORMAT_VERSION:
+		db.close()
+		return nil, ERR_NEEDS_UPGRADE
+	case db.version > FORMAT_VERSION:
+		db.close()
+		return nil, ERR_UNSUPPORTED_VERSION
+	}
+
+	if err := db.load(); err != nil {
+		db.close()
+		return nil, stackerr.Wrap(err)
+	}
+
+	return db, nil
+}
+
+// open maps a database file without reading its header, creating it in the
+// given format version if it's empty. it works out which version an existing
+// file is in from its signature; files without one are assumed to be from
+// before signatures existed, which is version 0.
+func open(filename string, version uint16) (*Database, error) {
+	log.Debugf("opening `%s'\n", filename)
+
 	fd, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, stackerr.Wrap(err)
@@ -46,40 +204,108 @@ func Open(filename string) (*Database, error) {
 
 	stat, err := fd.Stat()
 	if err != nil {
+		fd.Close()
 		return nil, stackerr.Wrap(err)
 	}
 
-	if stat.Size() < MINIMUM_HEADER_LENGTH {
-		if err := fd.Truncate(MINIMUM_HEADER_LENGTH); err != nil {
+	create := stat.Size() == 0
+
+	if create {
+		length := int64(headerLength(version))
+		if version > 0 {
+			length += SIGNATURE_LENGTH
+		}
+
+		if err := fd.Truncate(length); err != nil {
+			fd.Close()
 			return nil, stackerr.Wrap(err)
 		}
 	}
 
 	mm, err := mmap.Map(fd, mmap.RDWR, 0)
 	if err != nil {
+		fd.Close()
 		return nil, stackerr.Wrap(err)
 	}
 
+	if create && version > 0 {
+		copy(mm[0:6], SIGNATURE)
+		binary.BigEndian.PutUint16(mm[6:8], version)
+
+		// the empty header page still needs a valid checksum
+		if version >= 2 {
+			d := mm[SIGNATURE_LENGTH+1 : SIGNATURE_LENGTH+1+DATABASE_PAGE_LENGTH]
+			binary.BigEndian.PutUint32(d[20:24], crc32.Checksum(d[0:20], CRC_TABLE))
+		}
+	}
+
 	db := Database{
-		fd: fd,
-		mm: mm,
+		filename: filename,
+		fd:       fd,
+		mm:       mm,
 	}
 
-	page := mm[0]
+	if len(mm) >= SIGNATURE_LENGTH && string(mm[0:6]) == SIGNATURE {
+		db.version = binary.BigEndian.Uint16(mm[6:8])
+		db.base = SIGNATURE_LENGTH
+	}
+
+	log.Debugf("format version %d\n", db.version)
 
+	return &db, nil
+}
+
+// headerLength returns the length of the header (not including the signature)
+// in the given format version.
+func headerLength(version uint16) uint64 {
+	if version < 2 {
+		return 1 + 2*16
+	}
+
+	return 1 + 2*DATABASE_PAGE_LENGTH
+}
+
+// load reads the current database header.
+func (db *Database) load() error {
+	if len(db.mm) < int(db.base+headerLength(db.version)) {
+		return stackerr.New("file is too short to hold a header")
+	}
+
+	page := db.mm[db.base]
+	if page > 1 {
+		return stackerr.Newf("invalid header page %d", page)
+	}
+
+	// if the current header page is damaged, the other one still has the state
+	// as of the previous write
 	if err := db.readHeader(page); err != nil {
-		return nil, stackerr.Wrap(err)
+		if _, ok := err.(*CorruptionError); !ok {
+			return stackerr.Wrap(err)
+		}
+
+		log.Debugf("database header page %d is corrupt, trying page %d\n", page, page^1)
+
+		if db.readHeader(page^1) != nil {
+			return err
+		}
+
+		page ^= 1
 	}
 
 	db.page = page
 
-	// a new database has the "used" field set to 0, but the minimum header size
-	// is actually 33 bytes (a one byte page id and two 16 byte index/used pairs)
+	// a new database has the "used" field set to 0, but the header takes up the
+	// start of the file (a one byte page id and two header pages, plus the
+	// signature)
 	if db.used == 0 {
-		db.used = MINIMUM_HEADER_LENGTH
+		db.used = db.base + headerLength(db.version)
 	}
 
-	return &db, nil
+	if db.used > uint64(len(db.mm)) {
+		return stackerr.New("used space is larger than the file")
+	}
+
+	return nil
 }
 
 func (db *Database) Close() error {
@@ -105,6 +331,10 @@ func (db *Database) Close() error {
 
 	log.Debugf("locks acquired! closing time!\n")
 
+	return db.close()
+}
+
+func (db *Database) close() error {
 	if err := db.mm.Unmap(); err != nil {
 		return stackerr.Wrap(err)
 	}
@@ -126,14 +356,22 @@ func (db *Database) writeAndSwapHeader() error {
 		return stackerr.Wrap(err)
 	}
 
-	log.Debugf("before swap: %d/%d\n", db.page, db.mm[0])
+	log.Debugf("before swap: %d/%d\n", db.page, db.mm[db.base])
 
 	db.page ^= 1
-	db.mm[0] = db.page
+	db.mm[db.base] = db.page
+
+	log.Debugf("after swap: %d/%d\n", db.page, db.mm[db.base])
+
+	if err := db.mm.Flush(); err != nil {
+		return stackerr.Wrap(err)
+	}
 
-	log.Debugf("after swap: %d/%d\n", db.page, db.mm[0])
+	db.free = mergeFree(db.free, db.pending)
+	db.pending = db.released
+	db.released = nil
 
-	return db.mm.Flush()
+	return nil
 }
 
 func (db *Database) withLock(fn func() error) error {
@@ -147,7 +385,20 @@ func (db *Database) withLock(fn func() error) error {
 	return nil
 }
 
+// Stream returns the stream with the given name, creating it with the default
+// options if it doesn't exist.
 func (db *Database) Stream(name []byte) (*Stream, error) {
+	return db.stream(name, nil)
+}
+
+// StreamWithOptions is like Stream, but creates the stream with the given
+// options. If the stream already exists with different options, it returns
+// ERR_STREAM_OPTIONS_MISMATCH.
+func (db *Database) StreamWithOptions(name []byte, options StreamOptions) (*Stream, error) {
+	return db.stream(name, &options)
+}
+
+func (db *Database) stream(name []byte, options *StreamOptions) (*Stream, error) {
 	id := make([]byte, len(name))
 	copy(id, name)
 
@@ -157,12 +408,23 @@ func (db *Database) Stream(name []byte) (*Stream, error) {
 		if bytes.Equal(s.id, name) {
 			log.Debugf("fetching cached stream\n")
 
+			if options != nil && !options.equal(s.stream.Options()) {
+				return nil, ERR_STREAM_OPTIONS_MISMATCH
+			}
+
 			return s.stream, nil
 		}
 	}
 
-	if stream, err := newStream(db, id); err != nil {
+	create := StreamOptions{}
+	if options != nil {
+		create = *options
+	}
+
+	if stream, err := newStream(db, id, create); err != nil {
 		return nil, stackerr.Wrap(err)
+	} else if options != nil && !options.equal(stream.Options()) {
+		return nil, ERR_STREAM_OPTIONS_MISMATCH
 	} else {
 		db.streams = append(db.streams, &dbStream{
 			id:     id,
@@ -173,6 +435,104 @@ func (db *Database) Stream(name []byte) (*Stream, error) {
 	}
 }
 
+// LookupStream is like Stream, but it won't create the stream if it doesn't
+// exist. In that case, it returns ERR_STREAM_NOT_FOUND.
+func (db *Database) LookupStream(name []byte) (*Stream, error) {
+	log.Debugf("looking up stream `%s'\n", name)
+
+	if !db.hasRoot(name) {
+		return nil, ERR_STREAM_NOT_FOUND
+	}
+
+	return db.Stream(name)
+}
+
+// DeleteStream removes a stream from the database, and gives the space used by
+// its blocks back to be reused. Once deleted, the stream can't be used any more;
+// as with Close, any further transactions on it will block forever.
+func (db *Database) DeleteStream(name []byte) error {
+	log.Debugf("deleting stream `%s'\n", name)
+
+	s, err := db.LookupStream(name)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+
+	err = db.withLock(func() error {
+		for i, r := range db.roots {
+			if bytes.Equal(r.id, name) {
+				db.roots = append(db.roots[:i], db.roots[i+1:]...)
+				db.labels.remove(r)
+				break
+			}
+		}
+
+		for i, c := range db.streams {
+			if bytes.Equal(c.id, name) {
+				db.streams = append(db.streams[:i], db.streams[i+1:]...)
+				break
+			}
+		}
+
+		for _, b := range s.chain {
+			db.release(b.position, b.size())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if err := db.writeAndSwapHeader(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// Streams returns the names of all the streams in the database, in the order
+// that they were created.
+func (db *Database) Streams() [][]byte {
+	db.RLock()
+	defer db.RUnlock()
+
+	names := make([][]byte, len(db.roots))
+
+	for i, r := range db.roots {
+		names[i] = make([]byte, len(r.id))
+		copy(names[i], r.id)
+	}
+
+	return names
+}
+
+func (db *Database) hasRoot(id []byte) bool {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.root(id) != nil
+}
+
+// addRoot adds a stream to the index.
+func (db *Database) addRoot(r *dbRoot) {
+	db.roots = append(db.roots, r)
+	db.labels.add(r)
+}
+
+// root returns the index entry for a stream, or nil if there isn't one.
+func (db *Database) root(id []byte) *dbRoot {
+	for _, r := range db.roots {
+		if bytes.Equal(r.id, id) {
+			return r
+		}
+	}
+
+	return nil
+}
+
 func (db *Database) getBlock(position uint64) (*block, error) {
 	log.Debugf("getting block at %d\n", position)
 
@@ -183,22 +543,45 @@ func (db *Database) getBlock(position uint64) (*block, error) {
 	}
 }
 
-func (db *Database) newBlock(size uint32) (*block, error) {
+func (db *Database) newBlock(size uint32, options StreamOptions) (*block, error) {
 	log.Debugf("creating block of %d bytes\n", size)
 
-	position, err := db.allocate(93 + uint64(size))
+	header := blockHeaderLength(db.version)
+
+	position, err := db.allocate(header + uint64(size))
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
 
 	// explicitly zero out the header before block creation in case we're re-using
 	// reclaimed or previously-failed space
-	for i := 0; i < 93; i++ {
-		db.mm[int(position)+i] = 0
+	for i := uint64(0); i < header; i++ {
+		db.mm[position+i] = 0
 	}
 
 	binary.BigEndian.PutUint32(db.mm[position:position+4], size)
 
+	if db.version >= 3 {
+		types := fieldTypes(options.fields())
+
+		var floats uint32
+		for i, t := range types[1:] {
+			if t == TYPE_FLOAT64 {
+				floats |= 1 << uint(i)
+			}
+		}
+
+		db.mm[position+93] = byte(options.Precision)
+		db.mm[position+94] = byte(types[0])
+		db.mm[position+95] = byte(options.Codec)
+		db.mm[position+96] = byte(len(types) - 1)
+		binary.BigEndian.PutUint32(db.mm[position+97:position+101], floats)
+	}
+
+	// the empty header page still needs a valid checksum
+	empty := block{db: db, position: position}
+	binary.BigEndian.PutUint32(db.mm[position+5+BLOCK_PAGE_LENGTH-4:position+5+BLOCK_PAGE_LENGTH], empty.checksum(0))
+
 	if b, err := db.getBlock(position); err != nil {
 		return nil, stackerr.Wrap(err)
 	} else {
@@ -206,7 +589,9 @@ func (db *Database) newBlock(size uint32) (*block, error) {
 	}
 }
 
-func (db *Database) getRoot(id []byte) (*block, error) {
+// getRoot returns the root block of a stream, creating it with the given
+// options if the stream doesn't exist yet.
+func (db *Database) getRoot(id []byte, options StreamOptions) (*block, error) {
 	log.Debugf("getting root block `%s'\n", id)
 
 	for _, r := range db.roots {
@@ -223,12 +608,13 @@ func (db *Database) getRoot(id []byte) (*block, error) {
 
 	log.Debugf("creating new root block\n")
 
-	if root, err := db.newBlock(32); err != nil {
+	if root, err := db.newBlock(32, options); err != nil {
 		return nil, stackerr.Wrap(err)
 	} else {
-		db.roots = append(db.roots, &dbRoot{
-			id:       id,
-			position: root.position,
+		db.addRoot(&dbRoot{
+			id:         id,
+			position:   root.position,
+			properties: options.properties(),
 		})
 
 		if err := db.writeAndSwapHeader(); err != nil {
@@ -239,61 +625,123 @@ func (db *Database) getRoot(id []byte) (*block, error) {
 	}
 }
 
+// each header page holds the position of the index, the amount of the file
+// that's in use, the checksum of the index, and the checksum of the page
+// itself. before format version 2, there were no checksums.
+const DATABASE_PAGE_LENGTH = 24
+
 func (db *Database) readHeader(page byte) error {
 	log.Debugf("reading database header from page %d\n", page)
 
-	o := 1 + (page * 16)
+	var index, used uint64
+
+	if db.version < 2 {
+		o := db.base + 1 + uint64(page)*16
+
+		index = binary.BigEndian.Uint64(db.mm[o : o+8])
+		used = binary.BigEndian.Uint64(db.mm[o+8 : o+16])
+	} else {
+		o := db.base + 1 + uint64(page)*DATABASE_PAGE_LENGTH
+		d := db.mm[o : o+DATABASE_PAGE_LENGTH]
+
+		if crc32.Checksum(d[0:20], CRC_TABLE) != binary.BigEndian.Uint32(d[20:24]) {
+			return &CorruptionError{Position: o, What: "database header"}
+		}
 
-	index := binary.BigEndian.Uint64(db.mm[o : o+8])
-	used := binary.BigEndian.Uint64(db.mm[o+8 : o+16])
+		index = binary.BigEndian.Uint64(d[0:8])
+		used = binary.BigEndian.Uint64(d[8:16])
+
+		if index != 0 {
+			if index+8 > uint64(len(db.mm)) {
+				return &CorruptionError{Position: index, What: "index position"}
+			}
+
+			length := uint64(binary.BigEndian.Uint32(db.mm[index+4 : index+8]))
+			if index+length > uint64(len(db.mm)) {
+				return &CorruptionError{Position: index, What: "index length"}
+			}
+
+			if crc32.Checksum(db.mm[index:index+length], CRC_TABLE) != binary.BigEndian.Uint32(d[16:20]) {
+				return &CorruptionError{Position: index, What: "index"}
+			}
+		}
+	}
 
 	log.Debugf("index %d, used %d\n", index, used)
 
-	roots, err := db.readIndex(index)
+	idx, err := db.readIndex(index)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
 
 	db.index = index
+	db.indexLength = idx.length
 	db.used = used
-	db.roots = roots
+	db.roots = idx.roots
+	db.labels = idx.labels
+	db.free = idx.free
+	db.pending = idx.pending
+	db.released = nil
 
 	return nil
 }
 
-func (db *Database) readIndex(position uint64) ([]*dbRoot, error) {
+// dbIndex is the decoded contents of an index region.
+type dbIndex struct {
+	length  uint64
+	roots   []*dbRoot
+	labels  dbLabels
+	free    []*dbFree
+	pending []*dbFree
+}
+
+func (db *Database) readIndex(position uint64) (*dbIndex, error) {
 	log.Debugf("reading index from %d\n", position)
 
+	idx := dbIndex{labels: make(dbLabels)}
+
 	if position == 0 {
-		return nil, nil
+		return &idx, nil
 	}
 
-	if int(position) >= len(db.mm) {
+	if int(position)+4 > len(db.mm) {
 		return nil, stackerr.New("position was out of bounds")
 	}
 
 	count := int(binary.BigEndian.Uint32(db.mm[position : position+4]))
+	extended := count&INDEX_EXTENDED != 0
+	count &^= INDEX_EXTENDED
 
-	roots := make([]*dbRoot, count, count)
+	idx.roots = make([]*dbRoot, count, count)
 
 	o := int(position) + 4
+
+	if extended {
+		if o+4 > len(db.mm) {
+			return nil, stackerr.New("index length overruns bounds")
+		}
+		idx.length = uint64(binary.BigEndian.Uint32(db.mm[o : o+4]))
+
+		o += 4
+	}
+
 	for i := 0; i < count; i++ {
 		log.Debugf("reading root %d/%d from offset %d\n", i, count, o)
 
-		if o >= len(db.mm) {
+		if o+2 > len(db.mm) {
 			return nil, stackerr.New("stream id length overruns bounds")
 		}
 		streamIdSize := int(binary.BigEndian.Uint16(db.mm[o : o+2]))
 
 		log.Debugf("id size is %d\n", streamIdSize)
 
-		if o+streamIdSize >= len(db.mm) {
+		if o+2+streamIdSize > len(db.mm) {
 			return nil, stackerr.New("stream id overruns bounds")
 		}
 		streamId := make([]byte, streamIdSize)
 		copy(streamId, db.mm[o+2:o+2+streamIdSize])
 
-		if o >= len(db.mm) {
+		if o+2+streamIdSize+8 > len(db.mm) {
 			return nil, stackerr.New("stream position data overruns bounds")
 		}
 		streamPosition := binary.BigEndian.Uint64(db.mm[o+2+streamIdSize : o+2+streamIdSize+8])
@@ -302,65 +750,272 @@ func (db *Database) readIndex(position uint64) ([]*dbRoot, error) {
 
 		log.Debugf("adding root `%s' at %d\n", streamId, streamPosition)
 
-		roots[i] = &dbRoot{
+		idx.roots[i] = &dbRoot{
 			id:       streamId,
 			position: streamPosition,
 		}
+
+		// properties were added in format version 4
+		if db.version >= 4 {
+			properties, n, err := db.readProperties(o)
+			if err != nil {
+				return nil, stackerr.Wrap(err)
+			}
+
+			idx.roots[i].properties = properties
+
+			o = n
+		}
+	}
+
+	// the label index was added in format version 5. before that, it's built
+	// from the metadata of each stream.
+	if db.version < 5 {
+		idx.labels = buildLabels(idx.roots)
+	}
+
+	// older indexes don't record their length or have a free list, so their
+	// length is just the space taken up by the roots
+	if !extended {
+		idx.length = uint64(o) - position
+
+		return &idx, nil
+	}
+
+	free, o, err := db.readFreeList(o)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	idx.free = free
+
+	// the pending list was added in format version 2
+	if db.version >= 2 {
+		pending, n, err := db.readFreeList(o)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+
+		idx.pending = pending
+
+		o = n
+	}
+
+	if db.version >= 5 {
+		labels, _, err := db.readLabels(o, idx.roots)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+
+		idx.labels = labels
+	}
+
+	return &idx, nil
+}
+
+// readLabels reads the label index, which is a count of label names, then each
+// name followed by a count of its values. each value is followed by the number
+// of streams that have it, and their positions in the list of roots. names and
+// lengths are uint16s, and counts and positions are uint32s.
+func (db *Database) readLabels(o int, roots []*dbRoot) (dbLabels, int, error) {
+	labels := make(dbLabels)
+
+	str := func() (string, error) {
+		if o+2 > len(db.mm) {
+			return "", stackerr.New("label length overruns bounds")
+		}
+		n := int(binary.BigEndian.Uint16(db.mm[o : o+2]))
+
+		if o+2+n > len(db.mm) {
+			return "", stackerr.New("label overruns bounds")
+		}
+		s := string(db.mm[o+2 : o+2+n])
+
+		o += 2 + n
+
+		return s, nil
+	}
+
+	count := func() (int, error) {
+		if o+4 > len(db.mm) {
+			return 0, stackerr.New("label index count overruns bounds")
+		}
+		n := int(binary.BigEndian.Uint32(db.mm[o : o+4]))
+
+		o += 4
+
+		return n, nil
+	}
+
+	names, err := count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := 0; i < names; i++ {
+		name, err := str()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		values, err := count()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		labels[name] = make(map[string][]*dbRoot)
+
+		for j := 0; j < values; j++ {
+			value, err := str()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			n, err := count()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			if o+n*4 > len(db.mm) {
+				return nil, 0, stackerr.New("label index overruns bounds")
+			}
+
+			for k := 0; k < n; k++ {
+				r := int(binary.BigEndian.Uint32(db.mm[o : o+4]))
+				if r >= len(roots) {
+					return nil, 0, stackerr.Newf("label index refers to root %d of %d", r, len(roots))
+				}
+
+				labels[name][value] = append(labels[name][value], roots[r])
+
+				o += 4
+			}
+		}
+	}
+
+	return labels, o, nil
+}
+
+// readProperties reads the properties of a root, which are a count, followed by
+// the tag, length and data of each one.
+func (db *Database) readProperties(o int) ([]dbProperty, int, error) {
+	if o+2 > len(db.mm) {
+		return nil, 0, stackerr.New("property count overruns bounds")
+	}
+	count := int(binary.BigEndian.Uint16(db.mm[o : o+2]))
+
+	o += 2
+
+	properties := make([]dbProperty, count)
+
+	for i := range properties {
+		if o+5 > len(db.mm) {
+			return nil, 0, stackerr.New("property header overruns bounds")
+		}
+		length := int(binary.BigEndian.Uint32(db.mm[o+1 : o+5]))
+
+		if o+5+length > len(db.mm) {
+			return nil, 0, stackerr.New("property data overruns bounds")
+		}
+
+		properties[i].tag = db.mm[o]
+		properties[i].data = make([]byte, length)
+		copy(properties[i].data, db.mm[o+5:o+5+length])
+
+		log.Debugf("adding property %d of %d bytes\n", properties[i].tag, length)
+
+		o += 5 + length
+	}
+
+	return properties, o, nil
+}
+
+func (db *Database) readFreeList(o int) ([]*dbFree, int, error) {
+	if o+4 > len(db.mm) {
+		return nil, 0, stackerr.New("free list length overruns bounds")
+	}
+	count := int(binary.BigEndian.Uint32(db.mm[o : o+4]))
+
+	o += 4
+
+	if o+count*16 > len(db.mm) {
+		return nil, 0, stackerr.New("free list overruns bounds")
+	}
+
+	free := make([]*dbFree, count, count)
+
+	for i := 0; i < count; i++ {
+		free[i] = &dbFree{
+			position: binary.BigEndian.Uint64(db.mm[o : o+8]),
+			length:   binary.BigEndian.Uint64(db.mm[o+8 : o+16]),
+		}
+
+		log.Debugf("adding free region of %d bytes at %d\n", free[i].length, free[i].position)
+
+		o += 16
 	}
 
-	return roots, nil
+	return free, o, nil
 }
 
 func (db *Database) writeHeader(page byte) error {
 	log.Debugf("writing database header to page %d\n", page)
 
-	if newIndex, err := db.writeIndex(db.index); err != nil {
+	checksum, err := db.writeIndex()
+	if err != nil {
 		return stackerr.Wrap(err)
-	} else if db.index != newIndex {
-		db.index = newIndex
 	}
 
 	log.Debugf("index %d, used %d\n", db.index, db.used)
 
-	o := 1 + (page * 16)
+	o := db.base + 1 + uint64(page)*DATABASE_PAGE_LENGTH
+	d := db.mm[o : o+DATABASE_PAGE_LENGTH]
 
-	binary.BigEndian.PutUint64(db.mm[o:o+8], db.index)
-	binary.BigEndian.PutUint64(db.mm[o+8:o+16], db.used)
+	binary.BigEndian.PutUint64(d[0:8], db.index)
+	binary.BigEndian.PutUint64(d[8:16], db.used)
+	binary.BigEndian.PutUint32(d[16:20], checksum)
+	binary.BigEndian.PutUint32(d[20:24], crc32.Checksum(d[0:20], CRC_TABLE))
 
 	return nil
 }
 
-func (db *Database) writeIndex(position uint64) (uint64, error) {
-	log.Debugf("writing database index to position %d\n", position)
+// writeIndex writes the index to a newly allocated region, as the current one
+// is still referenced by the header that's in use, and returns its checksum.
+// the old region is released, but only becomes free once both header pages
+// have stopped referring to it.
+func (db *Database) writeIndex() (uint32, error) {
+	log.Debugf("writing database index\n")
 
-	requiredLength := 0
+	// allocating can only shrink the free list, and releasing the old index can
+	// add at most one region to the pending list
+	length := 8
 	for _, r := range db.roots {
-		requiredLength += 2 + len(r.id) + 8
+		length += r.length(db.version)
 	}
+	length += 4 + (len(db.free)+len(db.pending))*16
+	length += 4 + (len(db.released)+1)*16
 
-	length := 0
-
-	if position != 0 {
-		length = int(binary.BigEndian.Uint32(db.mm[int(position) : int(position)+4]))
+	if db.version >= 5 {
+		length += labelsLength(db.labels)
 	}
 
-	if length < requiredLength+4 {
-		length = requiredLength + 4
+	position, err := db.allocate(uint64(length))
+	if err != nil {
+		return 0, stackerr.Wrap(err)
+	}
 
-		if newPosition, err := db.allocate(uint64(length)); err != nil {
-			return 0, stackerr.Wrap(err)
-		} else if newPosition != position {
-			position = newPosition
-		}
+	if db.index != 0 {
+		db.release(db.index, db.indexLength)
 	}
 
 	index := db.mm[int(position) : int(position)+length]
 
 	log.Debugf("writing index root count of %d\n", len(db.roots))
 
-	binary.BigEndian.PutUint32(index[0:4], uint32(len(db.roots)))
+	binary.BigEndian.PutUint32(index[0:4], uint32(len(db.roots))|INDEX_EXTENDED)
+	binary.BigEndian.PutUint32(index[4:8], uint32(length))
 
-	o := 4
+	o := 8
 	for _, v := range db.roots {
 		log.Debugf("writing root record `%s' at offset %d\n", v.id, o)
 
@@ -369,14 +1024,152 @@ func (db *Database) writeIndex(position uint64) (uint64, error) {
 		binary.BigEndian.PutUint64(index[o+2+len(v.id):o+2+len(v.id)+8], v.position)
 
 		o += 2 + len(v.id) + 8
+
+		if db.version >= 4 {
+			o = writeProperties(index, o, v.properties)
+		}
 	}
 
-	return position, nil
+	// once this index is in use, the other header page is overwritten, so the
+	// pending regions are free. the released ones are still referenced by the
+	// other page, though.
+	o = writeFreeList(index, o, mergeFree(db.free, db.pending))
+	o = writeFreeList(index, o, mergeFree(db.released, nil))
+
+	if db.version >= 5 {
+		o = writeLabels(index, o, db.labels, db.roots)
+	}
+
+	db.index = position
+	db.indexLength = uint64(length)
+
+	return crc32.Checksum(index, CRC_TABLE), nil
 }
 
+func writeProperties(d []byte, o int, properties []dbProperty) int {
+	binary.BigEndian.PutUint16(d[o:o+2], uint16(len(properties)))
+
+	o += 2
+	for _, p := range properties {
+		d[o] = p.tag
+		binary.BigEndian.PutUint32(d[o+1:o+5], uint32(len(p.data)))
+		copy(d[o+5:o+5+len(p.data)], p.data)
+
+		o += 5 + len(p.data)
+	}
+
+	return o
+}
+
+// labelsLength returns the space that the label index takes up.
+func labelsLength(labels dbLabels) int {
+	n := 4
+
+	for name, values := range labels {
+		n += 2 + len(name) + 4
+
+		for value, roots := range values {
+			n += 2 + len(value) + 4 + len(roots)*4
+		}
+	}
+
+	return n
+}
+
+// writeLabels writes the label index, with the names and values in order so
+// that it's always written the same way.
+func writeLabels(d []byte, o int, labels dbLabels, roots []*dbRoot) int {
+	positions := make(map[*dbRoot]int)
+	for i, r := range roots {
+		positions[r] = i
+	}
+
+	str := func(s string) {
+		binary.BigEndian.PutUint16(d[o:o+2], uint16(len(s)))
+		copy(d[o+2:o+2+len(s)], s)
+
+		o += 2 + len(s)
+	}
+
+	count := func(n int) {
+		binary.BigEndian.PutUint32(d[o:o+4], uint32(n))
+
+		o += 4
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	count(len(names))
+
+	for _, name := range names {
+		values := make([]string, 0, len(labels[name]))
+		for value := range labels[name] {
+			values = append(values, value)
+		}
+
+		sort.Strings(values)
+
+		str(name)
+		count(len(values))
+
+		for _, value := range values {
+			str(value)
+			count(len(labels[name][value]))
+
+			for _, r := range labels[name][value] {
+				count(positions[r])
+			}
+		}
+	}
+
+	return o
+}
+
+func writeFreeList(d []byte, o int, free []*dbFree) int {
+	log.Debugf("writing free list count of %d\n", len(free))
+
+	binary.BigEndian.PutUint32(d[o:o+4], uint32(len(free)))
+
+	o += 4
+	for _, f := range free {
+		binary.BigEndian.PutUint64(d[o:o+8], f.position)
+		binary.BigEndian.PutUint64(d[o+8:o+16], f.length)
+
+		o += 16
+	}
+
+	return o
+}
+
+// allocate finds space for size bytes, reusing a free region if there's one
+// big enough, and growing the file if there's not.
 func (db *Database) allocate(size uint64) (uint64, error) {
 	log.Debugf("allocating %d bytes\n", size)
 
+	for i, f := range db.free {
+		if f.length < size {
+			continue
+		}
+
+		o := f.position
+
+		f.position += size
+		f.length -= size
+
+		if f.length == 0 {
+			db.free = append(db.free[:i], db.free[i+1:]...)
+		}
+
+		log.Debugf("allocated at %d from free list\n", o)
+
+		return o, nil
+	}
+
 	if len(db.mm)-int(db.used) < int(size) {
 		if err := db.expand(size); err != nil {
 			return 0, stackerr.Wrap(err)
@@ -392,6 +1185,49 @@ func (db *Database) allocate(size uint64) (uint64, error) {
 	return o, nil
 }
 
+// release gives up a region of the file. it won't be reused until two more
+// headers have been written, since until then one of the pages might refer to
+// it.
+func (db *Database) release(position, length uint64) {
+	log.Debugf("releasing %d bytes at %d\n", length, position)
+
+	db.released = append(db.released, &dbFree{
+		position: position,
+		length:   length,
+	})
+}
+
+// mergeFree combines two lists of free regions into a new list, sorted by
+// position, with adjacent regions joined together.
+func mergeFree(a, b []*dbFree) []*dbFree {
+	all := make([]*dbFree, 0, len(a)+len(b))
+	for _, f := range a {
+		all = append(all, &dbFree{f.position, f.length})
+	}
+	for _, f := range b {
+		all = append(all, &dbFree{f.position, f.length})
+	}
+
+	sort.Sort(freeByPosition(all))
+
+	merged := all[:0]
+	for _, f := range all {
+		if n := len(merged); n > 0 && merged[n-1].position+merged[n-1].length == f.position {
+			merged[n-1].length += f.length
+		} else {
+			merged = append(merged, f)
+		}
+	}
+
+	return merged
+}
+
+type freeByPosition []*dbFree
+
+func (f freeByPosition) Len() int           { return len(f) }
+func (f freeByPosition) Less(i, j int) bool { return f[i].position < f[j].position }
+func (f freeByPosition) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
 func (db *Database) expand(size uint64) error {
 	length := len(db.mm)
 
@@ -1,9 +1,17 @@
 package jikan
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/facebookgo/stackerr"
 )
 
 var (
@@ -176,3 +184,3456 @@ func TestDatabaseIterator(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestDatabaseRunLengthEncoding(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	base := time.Now()
+
+	f := func(tx *StreamTx) error {
+		for i := 0; i < 1000; i++ {
+			if err := tx.Add(base.Add(time.Second*time.Duration(i)), 5); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := s.WithTx(f); err != nil {
+		t.Error(err)
+	}
+
+	if len(s.chain) != 1 {
+		t.Errorf("expected repeated deltas to fit in one block, got %d", len(s.chain))
+	}
+
+	n := 0
+	for it := s.Iterator(); it.Good(); it.Next() {
+		if it.Value != 5 {
+			t.Errorf("expected value 5 at %d, got %d", n, it.Value)
+		}
+
+		n++
+	}
+
+	if n != 1000 {
+		t.Errorf("expected 1000 points, got %d", n)
+	}
+}
+
+func TestDatabaseRunLengthEncodingMixed(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	values := []int64{1, 1, 1, 2, 3, 3, 3, 3, 1, 2, 1, 2, 2, 2}
+
+	base := time.Now()
+
+	for i, v := range values {
+		err := s.WithTx(func(tx *StreamTx) error {
+			return tx.Add(base.Add(time.Second*time.Duration(i)), v)
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	n := 0
+	for it := s.Iterator(); it.Good(); it.Next() {
+		if n < len(values) && it.Value != values[n] {
+			t.Errorf("expected value %d at %d, got %d", values[n], n, it.Value)
+		}
+
+		n++
+	}
+
+	if n != len(values) {
+		t.Errorf("expected %d points, got %d", len(values), n)
+	}
+}
+
+func TestDatabaseRunLengthEncodingZeroCount(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.WithTx(func(tx *StreamTx) error { return tx.Add(time.Unix(1400000000, 0), 5) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// turn the only record into a run of 1<<32 points, which is zero once it's
+	// been cut down to a uint32
+	b := s.head
+
+	var buf [binary.MaxVarintLen64]byte
+	u := binary.PutVarint(buf[:], -(1 << 32))
+
+	d := append(buf[:u:u], b.data()[:b.used]...)
+	copy(b.data(), d)
+
+	b.used = uint32(len(d))
+	if err := b.writeAndSwapHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	it := s.Iterator()
+
+	n := 0
+	for ; it.Good() && n < 10; it.Next() {
+		n++
+	}
+
+	if n != 0 {
+		t.Errorf("expected no points from a run of zero, got at least %d", n)
+	}
+
+	if err := it.Seek(time.Time{}); err == nil {
+		t.Error("expected an error from a run of zero")
+	}
+
+	if problems, err := db.Verify(); err != nil {
+		t.Error(err)
+	} else if len(problems) == 0 {
+		t.Error("expected a bad record to be reported")
+	}
+}
+
+func TestDatabaseCancel(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	base := time.Now()
+
+	f := func(tx *StreamTx) error {
+		for i := 0; i < 10; i++ {
+			if err := tx.Add(base.Add(time.Second*time.Duration(i)), int64(i)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := s.WithTx(f); err != nil {
+		t.Error(err)
+	}
+
+	chain := len(s.chain)
+
+	tx := s.Tx()
+
+	for i := 10; i < 1000; i++ {
+		if err := tx.Add(base.Add(time.Second*time.Duration(i)), int64(i*i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := tx.Cancel(); err != nil {
+		t.Error(err)
+	}
+
+	if len(s.chain) != chain {
+		t.Errorf("expected chain length %d after cancel, got %d", chain, len(s.chain))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Error(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer db.Close()
+
+	s, err = db.Stream(s1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(s.chain) != chain {
+		t.Errorf("expected chain length %d after reopening, got %d", chain, len(s.chain))
+	}
+
+	n := 0
+	for it := s.Iterator(); it.Good(); it.Next() {
+		if it.Value != int64(n) {
+			t.Errorf("expected value %d at %d, got %d", n, n, it.Value)
+		}
+
+		n++
+	}
+
+	if n != 10 {
+		t.Errorf("expected 10 points, got %d", n)
+	}
+}
+
+func TestDatabaseIteratorRange(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	f := func(tx *StreamTx) error {
+		for i := 0; i < 500; i++ {
+			if err := tx.Add(base.Add(time.Minute*time.Duration(i)), int64(i%7)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := s.WithTx(f); err != nil {
+		t.Error(err)
+	}
+
+	from := base.Add(time.Minute * 120)
+	to := base.Add(time.Minute * 310)
+
+	n := 120
+	for it := s.Iterator().From(from).To(to); it.Good(); it.Next() {
+		if !it.Time.Equal(base.Add(time.Minute * time.Duration(n))) {
+			t.Errorf("expected time %s at %d, got %s", base.Add(time.Minute*time.Duration(n)), n, it.Time)
+		}
+
+		if it.Value != int64(n%7) {
+			t.Errorf("expected value %d at %d, got %d", n%7, n, it.Value)
+		}
+
+		n++
+	}
+
+	if n != 311 {
+		t.Errorf("expected iteration to stop after 310, stopped after %d", n-1)
+	}
+}
+
+func TestDatabaseIteratorSeek(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	f := func(tx *StreamTx) error {
+		for i := 0; i < 2000; i++ {
+			if err := tx.Add(base.Add(time.Second*time.Duration(i*i)), int64(i)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := s.WithTx(f); err != nil {
+		t.Error(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Error(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer db.Close()
+
+	s, err = db.Stream(s1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(s.chain) < 2 {
+		t.Errorf("expected more than one block, got %d", len(s.chain))
+	}
+
+	total := 0
+	for _, b := range s.chain {
+		total += int(b.count)
+	}
+
+	if total != 2000 {
+		t.Errorf("expected block counts to add up to 2000, got %d", total)
+	}
+
+	it := s.Iterator()
+
+	for _, i := range []int{1500, 3, 0, 1999, 700} {
+		if err := it.Seek(base.Add(time.Second*time.Duration(i*i) - time.Millisecond)); err != nil {
+			t.Error(err)
+		}
+
+		if !it.Good() {
+			t.Errorf("expected to find a point at %d", i)
+		} else if it.Value != int64(i) {
+			t.Errorf("expected seek to land on %d, got %d", i, it.Value)
+		}
+	}
+
+	if err := it.Seek(base.Add(time.Hour * 24 * 365)); err != nil {
+		t.Error(err)
+	}
+
+	if it.Good() {
+		t.Errorf("expected seeking past the end to exhaust the iterator")
+	}
+}
+
+func TestDatabaseIteratorSeekDuplicates(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+	at := base.Add(time.Minute)
+
+	// points at the same time, with values that don't run-length encode, span
+	// several blocks
+	err = s.WithTx(func(tx *StreamTx) error {
+		for i := 0; i < 10; i++ {
+			if err := tx.Add(base.Add(time.Second*time.Duration(i)), int64(i)); err != nil {
+				return err
+			}
+		}
+
+		for i := 0; i < 200; i++ {
+			if err := tx.Add(at, int64(i*i%1000)); err != nil {
+				return err
+			}
+		}
+
+		return tx.Add(at.Add(time.Second), 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	starts := 0
+	for _, b := range s.chain {
+		if b.startTime.Equal(at) {
+			starts++
+		}
+	}
+
+	if starts < 2 {
+		t.Fatalf("expected the points at the same time to span blocks, got %d", starts)
+	}
+
+	count := func(it *StreamIterator) int {
+		n := 0
+		for ; it.Good() && it.Time.Equal(at); it.Next() {
+			n++
+		}
+
+		return n
+	}
+
+	it := s.Iterator()
+	if err := it.Seek(at); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count(it); n != 200 {
+		t.Errorf("expected to seek to 200 points, got %d", n)
+	}
+
+	if n := count(s.Iterator().From(at)); n != 200 {
+		t.Errorf("expected 200 points from the time, got %d", n)
+	}
+}
+
+func TestDatabaseStreams(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, id := range [][]byte{s1, s2} {
+		if _, err := db.Stream(id); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Error(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer db.Close()
+
+	names := db.Streams()
+	if len(names) != 2 || !bytes.Equal(names[0], s1) || !bytes.Equal(names[1], s2) {
+		t.Errorf("expected streams %v and %v, got %v", s1, s2, names)
+	}
+
+	if _, err := db.LookupStream(s1); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := db.LookupStream([]byte("missing")); err != ERR_STREAM_NOT_FOUND {
+		t.Errorf("expected ERR_STREAM_NOT_FOUND, got %v", err)
+	}
+
+	if len(db.Streams()) != 2 {
+		t.Errorf("looking up a missing stream shouldn't create it")
+	}
+}
+
+func TestDatabaseStreamRange(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if first, last, err := s.Range(); err != nil {
+		t.Error(err)
+	} else if !first.IsZero() || !last.IsZero() {
+		t.Errorf("expected an empty range, got %s to %s", first, last)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	f := func(tx *StreamTx) error {
+		for i := 0; i < 300; i++ {
+			if err := tx.Add(base.Add(time.Second*time.Duration(i*i)), int64(i)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := s.WithTx(f); err != nil {
+		t.Error(err)
+	}
+
+	if n := s.Count(); n != 300 {
+		t.Errorf("expected 300 points, got %d", n)
+	}
+
+	if first, last, err := s.Range(); err != nil {
+		t.Error(err)
+	} else if !first.Equal(base) || !last.Equal(base.Add(time.Second*299*299)) {
+		t.Errorf("expected range %s to %s, got %s to %s", base, base.Add(time.Second*299*299), first, last)
+	}
+}
+
+func TestDatabaseDeleteStream(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	f := func(tx *StreamTx) error {
+		for i := 0; i < 1000; i++ {
+			if err := tx.Add(base.Add(time.Second*time.Duration(i*i)), int64(i)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := s.WithTx(f); err != nil {
+		t.Error(err)
+	}
+
+	var space uint64
+	for _, b := range s.chain {
+		space += 93 + uint64(b.length)
+	}
+
+	if err := db.DeleteStream(s1); err != nil {
+		t.Error(err)
+	}
+
+	if err := db.DeleteStream(s1); err != ERR_STREAM_NOT_FOUND {
+		t.Errorf("expected ERR_STREAM_NOT_FOUND, got %v", err)
+	}
+
+	used := db.used
+
+	if err := db.Close(); err != nil {
+		t.Error(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer db.Close()
+
+	if len(db.Streams()) != 0 {
+		t.Errorf("expected no streams, got %d", len(db.Streams()))
+	}
+
+	s, err = db.Stream(s2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := s.WithTx(f); err != nil {
+		t.Error(err)
+	}
+
+	if db.used-used >= space {
+		t.Errorf("expected the space from the deleted stream to be reused, but used grew from %d to %d", used, db.used)
+	}
+
+	if n := s.Count(); n != 1000 {
+		t.Errorf("expected 1000 points, got %d", n)
+	}
+
+	// a stream that's been deleted has nothing kept in the index, and can't
+	// have anything added to it
+	if err := db.DeleteStream(s2); err != nil {
+		t.Fatal(err)
+	}
+
+	if m := s.Metadata(); len(m.Labels) != 0 || m.Unit != "" {
+		t.Errorf("expected no metadata, got %v", m)
+	}
+
+	if r := s.Retention(); r != (Retention{}) {
+		t.Errorf("expected no retention, got %v", r)
+	}
+
+	if r := s.Rollups(); len(r) != 0 {
+		t.Errorf("expected no rollups, got %v", r)
+	}
+
+	if err := s.SetMetadata(Metadata{Unit: "s"}); err == nil || cause(err) != ERR_STREAM_NOT_FOUND {
+		t.Errorf("expected ERR_STREAM_NOT_FOUND, got %v", err)
+	}
+}
+
+func TestDatabaseCompact(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-compact.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer db.Close()
+
+	base := time.Unix(1400000000, 0)
+
+	for n, id := range [][]byte{s1, s2} {
+		s, err := db.Stream(id)
+		if err != nil {
+			t.Error(err)
+		}
+
+		f := func(tx *StreamTx) error {
+			for i := 0; i < 1000; i++ {
+				if err := tx.Add(base.Add(time.Second*time.Duration(i*i)), int64(i*n)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		if err := s.WithTx(f); err != nil {
+			t.Error(err)
+		}
+	}
+
+	saved, err := db.Compact("test-compact.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if saved <= 0 {
+		t.Errorf("expected compaction to save space, saved %d bytes", saved)
+	}
+
+	if _, err := db.Compact("test-compact.db"); err == nil {
+		t.Errorf("expected compacting over an existing file to fail")
+	}
+
+	dst, err := Open("test-compact.db")
+	if err != nil {
+		t.Error(err)
+	}
+
+	defer dst.Close()
+
+	if len(dst.free) != 0 {
+		t.Errorf("expected no free space in compacted database, got %d regions", len(dst.free))
+	}
+
+	if int(dst.used) != len(dst.mm) {
+		t.Errorf("expected compacted file to be %d bytes, got %d", dst.used, len(dst.mm))
+	}
+
+	for n, id := range [][]byte{s1, s2} {
+		s, err := dst.LookupStream(id)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if len(s.chain) != 1 {
+			t.Errorf("expected one block, got %d", len(s.chain))
+		}
+
+		i := 0
+		for it := s.Iterator(); it.Good(); it.Next() {
+			if !it.Time.Equal(base.Add(time.Second*time.Duration(i*i))) || it.Value != int64(i*n) {
+				t.Errorf("unexpected point %d: %s %d", i, it.Time, it.Value)
+			}
+
+			i++
+		}
+
+		if i != 1000 {
+			t.Errorf("expected 1000 points, got %d", i)
+		}
+	}
+}
+
+func TestDatabaseCompactGrowth(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-compact.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.StreamWithOptions(s1, StreamOptions{Type: TYPE_FLOAT64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetOutOfOrder(true); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	// every other point is late, and changes most of the bits of the floats
+	// that it's merged in between, so the merged points take a lot more space
+	// than the blocks do
+	for _, start := range []int{0, 1} {
+		err := s.WithTx(func(tx *StreamTx) error {
+			for i := start; i < 2000; i += 2 {
+				v := 1.0
+				if start == 1 {
+					v = -math.MaxFloat64 / float64(i)
+				}
+
+				if err := tx.AddFloat(base.Add(time.Second*time.Duration(i)), v); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.Compact("test-compact.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Open("test-compact.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dst.Close()
+
+	c, err := dst.LookupStream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.chain) != 1 {
+		t.Errorf("expected one block, got %d", len(c.chain))
+	}
+
+	if n := c.Count(); n != 2000 {
+		t.Errorf("expected 2000 points, got %d", n)
+	}
+}
+
+func TestDatabaseBadSignature(t *testing.T) {
+	defer os.Remove("test.db")
+
+	junk := make([]byte, 100)
+	for i := range junk {
+		junk[i] = byte(i * 7)
+	}
+
+	if err := ioutil.WriteFile("test.db", junk, 0644); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Open("test.db"); err != ERR_BAD_SIGNATURE {
+		t.Errorf("expected ERR_BAD_SIGNATURE, got %v", err)
+	}
+}
+
+func TestDatabaseUpgrade(t *testing.T) {
+	defer os.Remove("test.db")
+
+	// each of these was written by an older version, and has one stream,
+	// "stream", with 100 points in it
+	fixtures := []struct {
+		filename  string
+		version   uint16
+		err       error
+		precision Precision
+	}{
+		{"testdata/v0.db", 0, ERR_BAD_SIGNATURE, PRECISION_MICROSECOND},
+		{"testdata/v2.db", 2, ERR_NEEDS_UPGRADE, PRECISION_MICROSECOND},
+		{"testdata/v3.db", 3, ERR_NEEDS_UPGRADE, PRECISION_NANOSECOND},
+		{"testdata/v4.db", 4, ERR_NEEDS_UPGRADE, PRECISION_NANOSECOND},
+		{"testdata/v5.db", 5, ERR_NEEDS_UPGRADE, PRECISION_NANOSECOND},
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	for _, f := range fixtures {
+		data, err := ioutil.ReadFile(f.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile("test.db", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Open("test.db"); err != f.err {
+			t.Errorf("%s: expected %v, got %v", f.filename, f.err, err)
+		}
+
+		if version, err := Upgrade("test.db"); err != nil {
+			t.Error(err)
+		} else if version != f.version {
+			t.Errorf("%s: expected to upgrade from version %d, got %d", f.filename, f.version, version)
+		}
+
+		if version, err := Upgrade("test.db"); err != nil {
+			t.Error(err)
+		} else if version != FORMAT_VERSION {
+			t.Errorf("%s: expected database to be at version %d, got %d", f.filename, FORMAT_VERSION, version)
+		}
+
+		db, err := Open("test.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := db.LookupStream([]byte("stream"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// versions before 3 always stored microseconds
+		if p := s.Options().Precision; p != f.precision {
+			t.Errorf("%s: expected %s precision, got %s", f.filename, f.precision, p)
+		}
+
+		// labels were added in version 4, and have to be indexed when upgrading
+		if f.version >= 4 {
+			m, err := NewMatcher(MATCH_EQUAL, "region", "eu")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if streams, err := db.Select(m); err != nil {
+				t.Error(err)
+			} else if len(streams) != 1 || streams[0] != s {
+				t.Errorf("%s: expected to select the stream by its labels, got %v", f.filename, streams)
+			}
+		}
+
+		n := 0
+		for it := s.Iterator(); it.Good(); it.Next() {
+			if it.Value != int64(n) {
+				t.Errorf("%s: expected value %d at %d, got %d", f.filename, n, n, it.Value)
+			}
+
+			if tm := base.Add(time.Second * time.Duration(n*n)); !it.Time.Equal(tm) {
+				t.Errorf("%s: expected time %s at %d, got %s", f.filename, tm, n, it.Time)
+			}
+
+			n++
+		}
+
+		if n != 100 {
+			t.Errorf("%s: expected 100 points, got %d", f.filename, n)
+		}
+
+		// summaries were added in version 6, and have to be worked out when
+		// upgrading
+		if buckets, err := s.Aggregate(time.Time{}, time.Time{}, 0, Aggregation{Func: AGGREGATE_SUM}); err != nil {
+			t.Error(err)
+		} else if len(buckets) != 1 || buckets[0].Value != 4950 {
+			t.Errorf("%s: expected a sum of 4950, got %v", f.filename, buckets)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDatabaseChecksums(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range [][]byte{s1, s2} {
+		if _, err := db.Stream(id); err != nil {
+			t.Error(err)
+		}
+	}
+
+	page := db.page
+
+	if err := db.Close(); err != nil {
+		t.Error(err)
+	}
+
+	data, err := ioutil.ReadFile("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// damage the current header page, which should leave us with the previous
+	// state, where only the first stream existed
+	o := SIGNATURE_LENGTH + 1 + int(page)*DATABASE_PAGE_LENGTH
+	data[o+3] ^= 0xff
+
+	if err := ioutil.WriteFile("test.db", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(db.Streams()); n != 1 {
+		t.Errorf("expected to fall back to the header with 1 stream, got %d", n)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// now damage the other one too
+	o = SIGNATURE_LENGTH + 1 + int(page^1)*DATABASE_PAGE_LENGTH
+	data[o+3] ^= 0xff
+
+	if err := ioutil.WriteFile("test.db", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open("test.db"); err == nil {
+		t.Errorf("expected opening a database with no intact header to fail")
+	} else if _, ok := stackerr.Underlying(err)[len(stackerr.Underlying(err))-1].(*CorruptionError); !ok {
+		t.Errorf("expected a CorruptionError, got %v", err)
+	}
+}
+
+func TestDatabaseVerify(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	base := time.Unix(1400000000, 0)
+
+	f := func(tx *StreamTx) error {
+		for i := 0; i < 300; i++ {
+			if err := tx.Add(base.Add(time.Second*time.Duration(i*i)), int64(i)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, id := range [][]byte{s1, s2} {
+		s, err := db.Stream(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.WithTx(f); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if problems, err := db.Verify(); err != nil {
+		t.Error(err)
+	} else if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// point the last block back at the first one
+	s.head.next = s.chain[0].position
+	if err := s.head.writeAndSwapHeader(); err != nil {
+		t.Error(err)
+	}
+
+	// and cut the last record of a block in half
+	b := s.chain[1]
+	b.used--
+	if err := b.writeAndSwapHeader(); err != nil {
+		t.Error(err)
+	}
+
+	// and get the summary of a block in the other stream wrong
+	s, err = db.Stream(s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := s.chain[0]
+	c.summary.max++
+	if err := c.writeAndSwapHeader(); err != nil {
+		t.Error(err)
+	}
+
+	problems, err := db.Verify()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var loops, records, summaries int
+	for _, p := range problems {
+		if bytes.Equal(p.Stream, s2) && p.Position == c.position {
+			summaries++
+		} else if !bytes.Equal(p.Stream, s1) {
+			t.Errorf("unexpected problem: %s", p)
+		} else if p.Message == "block chain loops back on itself" {
+			loops++
+		} else if p.Position == b.position {
+			records++
+		}
+	}
+
+	if loops != 1 || records != 1 || summaries != 1 {
+		t.Errorf("expected a loop, a bad record and a bad summary, got %v", problems)
+	}
+}
+
+func TestDatabaseRepair(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-repair.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	f := func(tx *StreamTx) error {
+		for i := 0; i < 300; i++ {
+			if err := tx.Add(base.Add(time.Second*time.Duration(i*i)), int64(i)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, id := range [][]byte{s1, s2} {
+		s, err := db.Stream(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.WithTx(f); err != nil {
+			t.Error(err)
+		}
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.chain) < 3 {
+		t.Fatalf("expected at least 3 blocks, got %d", len(s.chain))
+	}
+
+	if err := s.SetMetadata(Metadata{Unit: "s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// wipe out both header pages of the second block, which cuts the rest of
+	// the chain off from the stream
+	first, b := s.chain[0].count, s.chain[1]
+	for i := b.position + 5; i < b.position+77; i++ {
+		db.mm[i] = 0
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair("test.db", "test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var broken bool
+	for _, p := range report.Problems {
+		if bytes.Equal(p.Stream, s1) && p.Position == b.position {
+			broken = true
+		}
+	}
+
+	if !broken {
+		t.Errorf("expected a problem with the block at %d, got %v", b.position, report.Problems)
+	}
+
+	db, err = Open("test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var total uint64
+	for _, name := range db.Streams() {
+		s, err := db.LookupStream(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var last time.Time
+		for it := s.Iterator(); it.Good(); it.Next() {
+			i := int(it.Value)
+			if !it.Time.Equal(base.Add(time.Second * time.Duration(i*i))) {
+				t.Errorf("`%s': point %d has the wrong time %s", name, i, it.Time)
+			}
+
+			if it.Time.Before(last) {
+				t.Errorf("`%s': point %d is out of order", name, i)
+			}
+
+			last = it.Time
+		}
+
+		switch {
+		case bytes.Equal(name, s2):
+			if s.Count() != 300 {
+				t.Errorf("expected 300 points in s2, got %d", s.Count())
+			}
+		case bytes.Equal(name, s1):
+			if s.Count() != uint64(first) {
+				t.Errorf("expected %d points in s1, got %d", first, s.Count())
+			}
+
+			if u := s.Metadata().Unit; u != "s" {
+				t.Errorf("expected s1 to keep its unit, got %q", u)
+			}
+		case !bytes.HasPrefix(name, []byte(LOST_AND_FOUND)):
+			t.Errorf("unexpected stream `%s'", name)
+		}
+
+		total += s.Count()
+	}
+
+	if total != 600-uint64(b.count) {
+		t.Errorf("expected %d points to be recovered, got %d", 600-b.count, total)
+	}
+}
+
+func TestDatabaseRepairDeleted(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-repair.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	for _, id := range [][]byte{s1, s2} {
+		s, err := db.Stream(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.WithTx(func(tx *StreamTx) error {
+			for i := 0; i < 500; i++ {
+				if err := tx.Add(base.Add(time.Second*time.Duration(i)), int64(i*i%1000)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.chain) < 3 {
+			t.Fatalf("expected at least 3 blocks, got %d", len(s.chain))
+		}
+	}
+
+	if err := db.DeleteStream(s1); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the header has been written again, the blocks are free, and joined
+	// together into one region, but they still have their headers
+	for i := 0; i < 2; i++ {
+		if err := db.writeAndSwapHeader(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair("test.db", "test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rs := range report.Streams {
+		if !bytes.Equal(rs.Name, s2) {
+			t.Errorf("expected only s2 to be recovered, got `%s' with %d points", rs.Name, rs.Recovered)
+		}
+	}
+
+	if len(report.Streams) != 1 || report.Streams[0].Recovered != 500 {
+		t.Errorf("expected 500 points from s2, got %v", report.Streams)
+	}
+}
+
+func TestDatabaseRepairLate(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-repair.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	for _, id := range [][]byte{s1, s2} {
+		s, err := db.Stream(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetOutOfOrder(true); err != nil {
+			t.Fatal(err)
+		}
+
+		// every other point, and then the ones in between, late
+		for _, start := range []int{0, 1} {
+			err := s.WithTx(func(tx *StreamTx) error {
+				for i := start; i < 100; i += 2 {
+					if err := tx.Add(base.Add(time.Second*time.Duration(i)), int64(i)); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n := len(s.late); n != 49 {
+			t.Fatalf("expected 49 late points, got %d", n)
+		}
+	}
+
+	// cut the last point off the late points of s2
+	if err := db.withLock(func() error {
+		d := db.root(s2).property(PROPERTY_LATE)
+		db.root(s2).setProperty(PROPERTY_LATE, d[:len(d)-1])
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.writeAndSwapHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair("test.db", "test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rs := range report.Streams {
+		var recovered, lost uint64 = 100, 0
+		if bytes.Equal(rs.Name, s2) {
+			recovered, lost = 51, 49
+		}
+
+		if rs.Recovered != recovered || rs.Lost != lost {
+			t.Errorf("`%s': expected %d points recovered and %d lost, got %v", rs.Name, recovered, lost, rs)
+		}
+	}
+
+	db, err = Open("test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.LookupStream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the late points are merged into the blocks, but the stream still takes
+	// them
+	if !s.OutOfOrder() || len(s.late) != 0 {
+		t.Errorf("expected an out of order stream with no late points, got %v and %d", s.OutOfOrder(), len(s.late))
+	}
+
+	n := 0
+	for it := s.Iterator(); it.Good(); it.Next() {
+		if !it.Time.Equal(base.Add(time.Second*time.Duration(n))) || it.Value != int64(n) {
+			t.Errorf("expected %d at %d, got %d at %s", n, n, it.Value, it.Time)
+		}
+
+		n++
+	}
+
+	if n != 100 {
+		t.Errorf("expected 100 points, got %d", n)
+	}
+}
+
+func TestDatabaseRepairTombstones(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-repair.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+	at := func(i int) time.Time {
+		return base.Add(time.Second * time.Duration(i))
+	}
+
+	add := func(from, to int) {
+		err := s.WithTx(func(tx *StreamTx) error {
+			for i := from; i < to; i++ {
+				if err := tx.Add(at(i), int64(i*i%1000)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add(0, 1000)
+
+	if len(s.chain) < 2 {
+		t.Fatalf("expected more than one block, got %d", len(s.chain))
+	}
+
+	err = s.WithTx(func(tx *StreamTx) error {
+		if err := tx.DeleteRange(at(100), at(599)); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteRange(at(990), at(999)); err != nil {
+			return err
+		}
+
+		return tx.Update(at(700), -1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// points added since aren't covered, even at the same times
+	add(999, 1100)
+
+	values := func(s *Stream) map[int64]int64 {
+		vs := make(map[int64]int64)
+		for it := s.Iterator(); it.Good(); it.Next() {
+			vs[it.Time.Unix()] += it.Value
+		}
+
+		return vs
+	}
+
+	expected := values(s)
+	if len(expected) != 591 || expected[at(700).Unix()] != -1 || expected[at(999).Unix()] != 999*999%1000 {
+		t.Fatalf("expected 591 points with an update, got %d", len(expected))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair("test.db", "test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) != 0 || len(report.Streams) != 1 || report.Streams[0].Lost != 0 {
+		t.Errorf("expected nothing to be lost, got %v", report)
+	}
+
+	db, err = Open("test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if s, err = db.LookupStream(s1); err != nil {
+		t.Fatal(err)
+	}
+
+	if vs := values(s); !reflect.DeepEqual(vs, expected) {
+		t.Errorf("expected %d points, got %d", len(expected), len(vs))
+	}
+
+	// and only those points are copied
+	if n := s.Count(); n != 591 {
+		t.Errorf("expected 591 points, got %d", n)
+	}
+}
+
+func TestDatabaseRepairProperties(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-repair.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000400, 0).Truncate(time.Hour)
+
+	add := func(s *Stream, from, to int) {
+		err := s.WithTx(func(tx *StreamTx) error {
+			for i := from; i < to; i++ {
+				if err := tx.Add(base.Add(time.Minute*time.Duration(i)), int64(i)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add(s, 0, 150)
+
+	retention := Retention{MaxAge: 24 * time.Hour, MaxPoints: 1000}
+	if err := s.SetRetention(retention); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AddRollup(Rollup{Step: time.Hour, Aggregations: []Aggregation{{Func: AGGREGATE_MEAN}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rollups := s.Rollups()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair("test.db", "test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) != 0 || len(report.Streams) != 2 {
+		t.Errorf("expected two streams and no problems, got %v", report)
+	}
+
+	db, err = Open("test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if s, err = db.LookupStream(s1); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := s.Retention(); r != retention {
+		t.Errorf("expected retention %v, got %v", retention, r)
+	}
+
+	if r := s.Rollups(); !reflect.DeepEqual(r, rollups) {
+		t.Errorf("expected rollups %v, got %v", rollups, r)
+	}
+
+	d, err := db.LookupStream(rollups[0].Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := d.Count(); n != 2 {
+		t.Errorf("expected 2 hours rolled up, got %d", n)
+	}
+
+	// the rollup carries on from where the repaired derived stream left off
+	add(s, 150, 200)
+
+	if n := d.Count(); n != 3 {
+		t.Errorf("expected 3 hours rolled up, got %d", n)
+	}
+}
+
+func TestDatabaseRepairDuplicates(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-repair.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetOutOfOrder(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetDuplicates(DUPLICATES_KEEP_LAST); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+	at := func(i int) time.Time {
+		return base.Add(time.Second * time.Duration(i))
+	}
+
+	// points replaced in the blocks, by a late point, and by a point at the
+	// head
+	batches := [][][2]int{
+		{{0, 1}, {0, 2}, {1, 3}, {2, 4}},
+		{{1, 5}, {2, 6}},
+	}
+
+	for _, batch := range batches {
+		err := s.WithTx(func(tx *StreamTx) error {
+			for _, p := range batch {
+				if err := tx.Add(at(p[0]), int64(p[1])); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values := func(s *Stream) [][2]int64 {
+		var vs [][2]int64
+		for it := s.Iterator(); it.Good(); it.Next() {
+			vs = append(vs, [2]int64{it.Time.Unix() - base.Unix(), it.Value})
+		}
+
+		return vs
+	}
+
+	expected := [][2]int64{{0, 2}, {1, 5}, {2, 6}}
+	if vs := values(s); !reflect.DeepEqual(vs, expected) {
+		t.Fatalf("expected %v, got %v", expected, vs)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair("test.db", "test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) != 0 || len(report.Streams) != 1 || report.Streams[0].Recovered != 3 || report.Streams[0].Lost != 0 {
+		t.Errorf("expected 3 points recovered and nothing lost, got %v", report)
+	}
+
+	db, err = Open("test-repair.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if s, err = db.LookupStream(s1); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := s.Duplicates(); p != DUPLICATES_KEEP_LAST {
+		t.Errorf("expected the stream to keep the last point, got %s", p)
+	}
+
+	if vs := values(s); !reflect.DeepEqual(vs, expected) {
+		t.Errorf("expected %v, got %v", expected, vs)
+	}
+
+	// and only those points are copied
+	if n := s.Count(); n != 3 {
+		t.Errorf("expected 3 points, got %d", n)
+	}
+}
+
+func TestDatabasePrecision(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	precisions := []Precision{
+		PRECISION_NANOSECOND,
+		PRECISION_MICROSECOND,
+		PRECISION_MILLISECOND,
+		PRECISION_SECOND,
+	}
+
+	base := time.Unix(1400000000, 123456789)
+
+	for _, p := range precisions {
+		s, err := db.StreamWithOptions([]byte(p.String()), StreamOptions{Precision: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.WithTx(func(tx *StreamTx) error {
+			for i := 0; i < 1000; i++ {
+				if err := tx.Add(base.Add(time.Duration(i*i)*time.Millisecond+time.Duration(i)), int64(i)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := db.StreamWithOptions([]byte("s"), StreamOptions{}); err != ERR_STREAM_OPTIONS_MISMATCH {
+		t.Errorf("expected ERR_STREAM_OPTIONS_MISMATCH, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	for _, p := range precisions {
+		s, err := db.LookupStream([]byte(p.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if o := s.Options().Precision; o != p {
+			t.Errorf("expected precision %s, got %s", p, o)
+		}
+
+		i := 0
+		for it := s.Iterator(); it.Good(); it.Next() {
+			tm := base.Add(time.Duration(i*i)*time.Millisecond + time.Duration(i)).Truncate(p.Duration())
+			if !it.Time.Equal(tm) {
+				t.Errorf("%s: expected time %s at %d, got %s", p, tm.Format(time.RFC3339Nano), i, it.Time.Format(time.RFC3339Nano))
+			}
+
+			i++
+		}
+
+		if i != 1000 {
+			t.Errorf("%s: expected 1000 points, got %d", p, i)
+		}
+
+		if first, last, err := s.Range(); err != nil {
+			t.Error(err)
+		} else if !first.Equal(base.Truncate(p.Duration())) || !last.Equal(base.Add(time.Duration(999*999)*time.Millisecond+999).Truncate(p.Duration())) {
+			t.Errorf("%s: unexpected range %s - %s", p, first, last)
+		}
+	}
+}
+
+func TestDatabaseFloat(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-compact.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	values := make([]float64, 1000)
+	for i := range values {
+		switch {
+		case i%100 == 0:
+			values[i] = math.NaN()
+		case i%50 == 0:
+			values[i] = math.Inf(-1)
+		case i%10 == 0:
+			values[i] = values[i-1]
+		default:
+			values[i] = 20 + math.Sin(float64(i)/10)*float64(i)
+		}
+	}
+
+	codecs := map[string]CodecID{
+		"rle":     CODEC_RLE,
+		"gorilla": CODEC_GORILLA,
+		"varint":  CODEC_VARINT,
+	}
+
+	for name, codec := range codecs {
+		s, err := db.StreamWithOptions([]byte(name), StreamOptions{Type: TYPE_FLOAT64, Codec: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.WithTx(func(tx *StreamTx) error {
+			if err := tx.Add(base, 1); err != ERR_WRONG_VALUE_TYPE {
+				t.Errorf("expected ERR_WRONG_VALUE_TYPE, got %v", err)
+			}
+
+			for i, v := range values {
+				if err := tx.AddFloat(base.Add(time.Second*time.Duration(i)), v); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	i, err := db.Stream(s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := i.Tx()
+	if err := tx.AddFloat(base, 1.5); err != ERR_WRONG_VALUE_TYPE {
+		t.Errorf("expected ERR_WRONG_VALUE_TYPE, got %v", err)
+	}
+
+	if err := tx.Cancel(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := db.Compact("test-compact.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{"test.db", "test-compact.db"} {
+		db, err := Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name := range codecs {
+			s, err := db.LookupStream([]byte(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if typ := s.Options().Type; typ != TYPE_FLOAT64 {
+				t.Errorf("%s/%s: expected a float stream, got %s", filename, name, typ)
+			}
+
+			n := 0
+			for it := s.Iterator(); it.Good(); it.Next() {
+				if math.Float64bits(it.FloatValue) != math.Float64bits(values[n]) {
+					t.Errorf("%s/%s: expected value %v at %d, got %v", filename, name, values[n], n, it.FloatValue)
+				}
+
+				n++
+			}
+
+			if n != len(values) {
+				t.Errorf("%s/%s: expected %d points, got %d", filename, name, len(values), n)
+			}
+		}
+
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDatabaseGorilla(t *testing.T) {
+	defer os.Remove("test.db")
+
+	base := time.Unix(1400000000, 0)
+
+	// regular points, with some jitter, gaps and repeated times mixed in
+	times := make([]time.Time, 3000)
+	for i := range times {
+		switch {
+		case i == 0:
+			times[i] = base
+		case i%500 == 0:
+			times[i] = times[i-1].Add(time.Hour * 24 * 365)
+		case i%37 == 0:
+			times[i] = times[i-1]
+		case i%7 == 0:
+			times[i] = times[i-1].Add(time.Second*10 + time.Millisecond*time.Duration(i%13))
+		default:
+			times[i] = times[i-1].Add(time.Second * 10)
+		}
+	}
+
+	value := func(i int) int64 {
+		return int64(i/10) - int64(i%3)*1000000
+	}
+
+	options := StreamOptions{Codec: CODEC_GORILLA, Precision: PRECISION_MILLISECOND}
+
+	add := func(from, to int, cancel bool) {
+		db, err := Open("test.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer db.Close()
+
+		s, err := db.StreamWithOptions(s1, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx := s.Tx()
+		for i := from; i < to; i++ {
+			if err := tx.Add(times[i], value(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if cancel {
+			err = tx.Cancel()
+		} else {
+			err = tx.Commit()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// adding to the stream after reopening it has to pick up where the data
+	// left off, even after a cancelled transaction
+	add(0, 1000, false)
+	add(1000, 1500, true)
+	add(1000, 2000, false)
+	add(2000, 3000, false)
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.LookupStream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := s.Options().Codec; c != CODEC_GORILLA {
+		t.Errorf("expected the gorilla codec, got %s", c)
+	}
+
+	n := 0
+	for it := s.Iterator(); it.Good(); it.Next() {
+		if !it.Time.Equal(times[n]) || it.Value != value(n) {
+			t.Errorf("expected %s/%d at %d, got %s/%d", times[n], value(n), n, it.Time, it.Value)
+		}
+
+		n++
+	}
+
+	if n != len(times) {
+		t.Errorf("expected %d points, got %d", len(times), n)
+	}
+
+	if problems, err := db.Verify(); err != nil {
+		t.Error(err)
+	} else if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
+
+func TestDatabaseFields(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-compact.db")
+
+	base := time.Unix(1400000000, 0)
+
+	fields := []Field{
+		{Name: "min", Type: TYPE_INT64},
+		{Name: "max", Type: TYPE_INT64},
+		{Name: "avg", Type: TYPE_FLOAT64},
+	}
+
+	// every tenth row repeats the one before it, so there are runs to encode
+	row := func(i int) (int64, int64, float64) {
+		if i%10 == 9 {
+			i--
+		}
+
+		return int64(i % 7), int64(100 + i/3), float64(i%7+100+i/3) / 2
+	}
+
+	codecs := map[string]CodecID{
+		"rle":     CODEC_RLE,
+		"gorilla": CODEC_GORILLA,
+		"varint":  CODEC_VARINT,
+	}
+
+	// the second half is added after reopening, so appending has to work out
+	// the last value of every field again
+	add := func(from, to int) {
+		db, err := Open("test.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer db.Close()
+
+		for name, codec := range codecs {
+			s, err := db.StreamWithOptions([]byte(name), StreamOptions{Codec: codec, Fields: fields})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.WithTx(func(tx *StreamTx) error {
+				for i := from; i < to; i++ {
+					min, max, avg := row(i)
+
+					if err := tx.AddRow(base.Add(time.Second*time.Duration(i)), min, max, avg); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	add(0, 500)
+	add(500, 1000)
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.StreamWithOptions([]byte("bad"), StreamOptions{Fields: []Field{{"a", TYPE_INT64}, {"a", TYPE_INT64}}}); err == nil || stackerr.Underlying(err)[len(stackerr.Underlying(err))-1] != ERR_BAD_FIELDS {
+		t.Errorf("expected ERR_BAD_FIELDS, got %v", err)
+	}
+
+	if _, err := db.StreamWithOptions([]byte("rle"), StreamOptions{Fields: fields[:2]}); err != ERR_STREAM_OPTIONS_MISMATCH {
+		t.Errorf("expected ERR_STREAM_OPTIONS_MISMATCH, got %v", err)
+	}
+
+	s, err := db.LookupStream([]byte("rle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := s.Tx()
+
+	if err := tx.Add(base, 1); err != ERR_WRONG_FIELD_COUNT {
+		t.Errorf("expected ERR_WRONG_FIELD_COUNT, got %v", err)
+	}
+
+	if err := tx.AddRow(base, 1, 2); err != ERR_WRONG_FIELD_COUNT {
+		t.Errorf("expected ERR_WRONG_FIELD_COUNT, got %v", err)
+	}
+
+	if err := tx.AddRow(base, 1, 2.5, 3.5); err != ERR_WRONG_VALUE_TYPE {
+		t.Errorf("expected ERR_WRONG_VALUE_TYPE, got %v", err)
+	}
+
+	if err := tx.Cancel(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := db.Compact("test-compact.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{"test.db", "test-compact.db"} {
+		db, err := Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name := range codecs {
+			s, err := db.LookupStream([]byte(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if f := s.Fields(); !equalFields(f, fields) {
+				t.Errorf("%s/%s: expected fields %v, got %v", filename, name, fields, f)
+			}
+
+			n := 0
+			for it := s.Iterator(); it.Good(); it.Next() {
+				min, max, avg := row(n)
+
+				if !it.Time.Equal(base.Add(time.Second*time.Duration(n))) || it.Value != min || it.Field(1) != max || it.FloatField(2) != avg {
+					t.Errorf("%s/%s: expected %d/%d/%v at %d, got %s %d/%d/%v", filename, name, min, max, avg, n, it.Time, it.Value, it.Field(1), it.FloatField(2))
+				}
+
+				n++
+			}
+
+			if n != 1000 {
+				t.Errorf("%s/%s: expected 1000 points, got %d", filename, name, n)
+			}
+		}
+
+		if problems, err := db.Verify(); err != nil {
+			t.Error(err)
+		} else if len(problems) != 0 {
+			t.Errorf("%s: expected no problems, got %v", filename, problems)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDatabaseMetadata(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test-compact.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := db.Stream(s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m := a.Metadata(); len(m.Labels) != 0 || m.Unit != "" || m.Description != "" {
+		t.Errorf("expected no metadata, got %v", m)
+	}
+
+	if err := a.SetMetadata(Metadata{Labels: map[string]string{"": "x"}}); err != ERR_BAD_METADATA {
+		t.Errorf("expected ERR_BAD_METADATA, got %v", err)
+	}
+
+	metadata := Metadata{
+		Labels:      map[string]string{"host": "web1", "metric": "cpu"},
+		Unit:        "%",
+		Description: "CPU usage",
+	}
+
+	if err := a.SetMetadata(metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.SetMetadata(Metadata{Labels: map[string]string{"host": "web2", "metric": "cpu"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.SetMetadata(Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Compact("test-compact.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseLabels("host"); err != ERR_BAD_LABELS {
+		t.Errorf("expected ERR_BAD_LABELS, got %v", err)
+	}
+
+	selector, err := ParseLabels("host=web1,metric=cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{"test.db", "test-compact.db"} {
+		db, err := Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, err := db.LookupStream(s1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := db.LookupStream(s2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m := a.Metadata(); !reflect.DeepEqual(m, metadata) {
+			t.Errorf("%s: expected metadata %v, got %v", filename, metadata, m)
+		}
+
+		if m := b.Metadata(); len(m.Labels) != 0 || m.Unit != "" || m.Description != "" {
+			t.Errorf("%s: expected no metadata, got %v", filename, m)
+		}
+
+		if !a.Metadata().Matches(selector) || b.Metadata().Matches(selector) {
+			t.Errorf("%s: expected the selector to match only the first stream", filename)
+		}
+
+		if problems, err := db.Verify(); err != nil {
+			t.Error(err)
+		} else if len(problems) != 0 {
+			t.Errorf("%s: expected no problems, got %v", filename, problems)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDatabaseSelect(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]map[string]string{
+		"a": {"region": "eu", "host": "web1"},
+		"b": {"region": "eu", "host": "db1"},
+		"c": {"region": "us", "host": "web2"},
+		"d": nil,
+		"e": {"region": "eu", "host": "web3"},
+	}
+
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		s, err := db.Stream([]byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetMetadata(Metadata{Labels: labels[name]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// moving a stream to another region, and deleting one, have to update the
+	// index as well as the metadata
+	e, err := db.Stream([]byte("e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.SetMetadata(Metadata{Labels: map[string]string{"region": "us", "host": "web3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DeleteStream([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseMatchers("host"); err != ERR_BAD_MATCHER {
+		t.Errorf("expected ERR_BAD_MATCHER, got %v", err)
+	}
+
+	if _, err := ParseMatchers("host=~("); err == nil {
+		t.Errorf("expected a bad regexp to be rejected")
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	queries := map[string]string{
+		"":                        "a,c,d,e",
+		"region=eu":               "a",
+		"region=us":               "c,e",
+		"host=~web.*":             "a,c,e",
+		"region=us,host=~web[13]": "e",
+		"region=~eu|us":           "a,c,e",
+		"region=asia":             "",
+		"zone=~.*":                "",
+	}
+
+	for query, expected := range queries {
+		matchers, err := ParseMatchers(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		streams, err := db.Select(matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, s := range streams {
+			names = append(names, string(s.Name()))
+		}
+
+		if got := strings.Join(names, ","); got != expected {
+			t.Errorf("%q: expected %q, got %q", query, expected, got)
+		}
+	}
+
+	if problems, err := db.Verify(); err != nil {
+		t.Error(err)
+	} else if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
+
+func TestDatabaseAggregate(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000400, 0).Truncate(time.Hour)
+
+	// a point a minute, with the value counting minutes, except for a gap of
+	// two hours from the fifth
+	err = s.WithTx(func(tx *StreamTx) error {
+		for i := 0; i < 1000; i++ {
+			if i >= 300 && i < 420 {
+				continue
+			}
+
+			if err := tx.Add(base.Add(time.Minute*time.Duration(i)), int64(i)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every full hour holds 60 consecutive values, starting at 60 times the
+	// hour
+	stddev := math.Sqrt((60*60 - 1) / 12.0)
+
+	tests := []struct {
+		fn    string
+		value func(h float64) float64
+	}{
+		{"count", func(h float64) float64 { return 60 }},
+		{"sum", func(h float64) float64 { return 60*60*h + 59*30 }},
+		{"min", func(h float64) float64 { return 60 * h }},
+		{"max", func(h float64) float64 { return 60*h + 59 }},
+		{"mean", func(h float64) float64 { return 60*h + 29.5 }},
+		{"first", func(h float64) float64 { return 60 * h }},
+		{"last", func(h float64) float64 { return 60*h + 59 }},
+		{"stddev", func(h float64) float64 { return stddev }},
+		{"p50", func(h float64) float64 { return 60*h + 29.5 }},
+		{"p0", func(h float64) float64 { return 60 * h }},
+		{"p100", func(h float64) float64 { return 60*h + 59 }},
+	}
+
+	for _, test := range tests {
+		fn, err := ParseAggregation(test.fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buckets, err := s.Aggregate(time.Time{}, time.Time{}, time.Hour, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the hours in the gap are left out, and the last hour isn't full
+		if len(buckets) != 15 {
+			t.Errorf("%s: expected 15 buckets, got %d", test.fn, len(buckets))
+			continue
+		}
+
+		for i, b := range buckets[:len(buckets)-1] {
+			h := i
+			if h >= 5 {
+				h += 2
+			}
+
+			if !b.Start.Equal(base.Add(time.Hour*time.Duration(h))) || b.Count != 60 {
+				t.Errorf("%s: expected 60 points at hour %d, got %d at %s", test.fn, h, b.Count, b.Start)
+			}
+
+			if v := test.value(float64(h)); math.Abs(b.Value-v) > 1e-9 {
+				t.Errorf("%s: expected %v at hour %d, got %v", test.fn, v, h, b.Value)
+			}
+		}
+
+		if b := buckets[len(buckets)-1]; b.Count != 40 {
+			t.Errorf("%s: expected 40 points in the last bucket, got %d", test.fn, b.Count)
+		}
+	}
+
+	// buckets are aligned to the start of the range, and the end of it is left
+	// out
+	sum := Aggregation{Func: AGGREGATE_SUM}
+
+	buckets, err := s.Aggregate(base.Add(time.Minute*30), base.Add(time.Minute*90), time.Hour, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(buckets) != 1 || !buckets[0].Start.Equal(base.Add(time.Minute*30)) || buckets[0].Count != 60 || buckets[0].Value != 30*60+59*30 {
+		t.Errorf("expected one bucket of 60 points from 30 minutes in, got %v", buckets)
+	}
+
+	buckets, err = s.Aggregate(time.Time{}, time.Time{}, 0, Aggregation{Func: AGGREGATE_COUNT})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(buckets) != 1 || buckets[0].Count != 880 {
+		t.Errorf("expected one bucket of 880 points, got %v", buckets)
+	}
+
+	// blocks that are entirely in one bucket are aggregated from their
+	// summaries, which have to agree with their points
+	if len(s.chain) < 2 {
+		t.Fatalf("expected more than one block, got %d", len(s.chain))
+	}
+
+	for _, b := range s.chain {
+		if summary, err := b.summarize(); err != nil {
+			t.Error(err)
+		} else if !summary.equal(b.summary) {
+			t.Errorf("expected block at %d to have summary %v, got %v", b.position, summary, b.summary)
+		}
+	}
+
+	whole := map[AggregateFunc]float64{
+		AGGREGATE_SUM:   999*1000/2 - (300+419)*120/2,
+		AGGREGATE_MIN:   0,
+		AGGREGATE_MAX:   999,
+		AGGREGATE_MEAN:  (999*1000/2 - (300+419)*120/2) / 880.0,
+		AGGREGATE_FIRST: 0,
+		AGGREGATE_LAST:  999,
+	}
+
+	for fn, v := range whole {
+		buckets, err := s.Aggregate(time.Time{}, time.Time{}, 0, Aggregation{Func: fn})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(buckets) != 1 || buckets[0].Count != 880 || buckets[0].Value != v {
+			t.Errorf("%s: expected one bucket of 880 points with value %v, got %v", fn, v, buckets)
+		}
+	}
+
+	for _, name := range []string{"median", "p101", "p"} {
+		if _, err := ParseAggregation(name); err != ERR_BAD_AGGREGATION {
+			t.Errorf("%s: expected ERR_BAD_AGGREGATION, got %v", name, err)
+		}
+	}
+
+	if _, err := s.Aggregate(time.Time{}, time.Time{}, time.Hour, Aggregation{Field: 1}); err != ERR_BAD_AGGREGATION {
+		t.Errorf("expected ERR_BAD_AGGREGATION, got %v", err)
+	}
+}
+
+func TestDatabaseRollup(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000400, 0).Truncate(time.Hour)
+
+	// a point a minute, with the value counting minutes
+	add := func(from, to int) {
+		err := s.WithTx(func(tx *StreamTx) error {
+			for i := from; i < to; i++ {
+				if err := tx.Add(base.Add(time.Minute*time.Duration(i)), int64(i)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add(0, 150)
+
+	rollup := Rollup{
+		Step: time.Hour,
+		Aggregations: []Aggregation{
+			{Func: AGGREGATE_MEAN},
+			{Func: AGGREGATE_MAX},
+			{Func: AGGREGATE_PERCENTILE, Percentile: 50},
+		},
+	}
+
+	if err := s.AddRollup(rollup); err != nil {
+		t.Fatal(err)
+	}
+
+	// only hours that are over are rolled up, and then the rest once a commit
+	// takes the stream past them
+	check := func(db *Database, hours int) {
+		d, err := db.LookupStream([]byte(string(s1) + "@1h"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields := []Field{{"mean", TYPE_FLOAT64}, {"max", TYPE_FLOAT64}, {"p50", TYPE_FLOAT64}}
+		if !reflect.DeepEqual(d.Fields(), fields) {
+			t.Errorf("expected fields %v, got %v", fields, d.Fields())
+		}
+
+		n := 0
+		for it := d.Iterator(); it.Good(); it.Next() {
+			if tm := base.Add(time.Hour * time.Duration(n)); !it.Time.Equal(tm) {
+				t.Errorf("expected time %s at %d, got %s", tm, n, it.Time)
+			}
+
+			if v := float64(60*n) + 29.5; it.FloatField(0) != v || it.FloatField(2) != v {
+				t.Errorf("expected a mean and median of %v at %d, got %v and %v", v, n, it.FloatField(0), it.FloatField(2))
+			}
+
+			if v := float64(60*n + 59); it.FloatField(1) != v {
+				t.Errorf("expected a maximum of %v at %d, got %v", v, n, it.FloatField(1))
+			}
+
+			n++
+		}
+
+		if n != hours {
+			t.Errorf("expected %d hours, got %d", hours, n)
+		}
+	}
+
+	check(db, 2)
+
+	add(150, 179)
+	check(db, 2)
+
+	add(179, 250)
+	check(db, 4)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err = db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rollups := s.Rollups()
+	if len(rollups) != 1 || string(rollups[0].Stream) != string(s1)+"@1h" || !reflect.DeepEqual(rollups[0].Aggregations, rollup.Aggregations) {
+		t.Errorf("expected the rollup to be kept, got %v", rollups)
+	}
+
+	add(250, 301)
+	check(db, 5)
+
+	d, err := db.Stream([]byte(string(s1) + "@1h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rollup that leads back to its source would wait on itself
+	if err := d.AddRollup(Rollup{Stream: s1, Step: time.Hour, Aggregations: []Aggregation{{}}}); err != ERR_BAD_ROLLUP {
+		t.Errorf("expected ERR_BAD_ROLLUP, got %v", err)
+	}
+
+	for _, r := range []Rollup{
+		{Step: 0, Aggregations: []Aggregation{{}}},
+		{Step: time.Hour},
+		{Step: time.Hour, Aggregations: []Aggregation{{}, {}}},
+		{Step: time.Hour, Aggregations: []Aggregation{{Field: 1}}},
+		{Stream: s1, Step: time.Hour, Aggregations: []Aggregation{{}}},
+		rollup,
+	} {
+		if err := s.AddRollup(r); err != ERR_BAD_ROLLUP {
+			t.Errorf("%v: expected ERR_BAD_ROLLUP, got %v", r, err)
+		}
+	}
+
+	if err := s.RemoveRollup([]byte(string(s1) + "@1h")); err != nil {
+		t.Error(err)
+	}
+
+	if rollups := s.Rollups(); len(rollups) != 0 {
+		t.Errorf("expected no rollups, got %v", rollups)
+	}
+
+	add(301, 400)
+	check(db, 5)
+
+	// compacting copies the derived stream as it is, rather than rolling it up
+	// again
+	defer os.Remove("compact.db")
+
+	if _, err := db.Compact("compact.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := Open("compact.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer compacted.Close()
+
+	if streams := compacted.Streams(); len(streams) != 2 {
+		t.Errorf("expected 2 streams, got %d", len(streams))
+	}
+
+	check(compacted, 5)
+
+	if problems, err := db.Verify(); err != nil {
+		t.Error(err)
+	} else if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+
+	// a rollup that can't be kept up to date doesn't undo the commit
+	broken := Rollup{Stream: []byte("broken"), Step: time.Hour, Aggregations: []Aggregation{{}}}
+	if err := s.AddRollup(broken); err != nil {
+		t.Fatal(err)
+	}
+
+	// and a derived stream can only have one source
+	o, err := db.Stream(s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.AddRollup(broken); err != ERR_BAD_ROLLUP {
+		t.Errorf("expected ERR_BAD_ROLLUP for a second source, got %v", err)
+	}
+
+	if err := db.DeleteStream(broken.Stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.StreamWithOptions(broken.Stream, StreamOptions{Type: TYPE_INT64}); err != nil {
+		t.Fatal(err)
+	}
+
+	n := s.Count()
+
+	err = s.WithTx(func(tx *StreamTx) error {
+		return tx.Add(base.Add(time.Minute*500), 500)
+	})
+	if _, ok := cause(err).(*CommittedError); err == nil || !ok {
+		t.Errorf("expected a CommittedError, got %v", err)
+	}
+
+	if s.Count() != n+1 {
+		t.Errorf("expected the point to be committed, got %d points", s.Count())
+	}
+}
+
+func TestDatabaseRetention(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	// a point a second, with values that don't run-length encode
+	value := func(i int) int64 {
+		return int64(i * i % 1000)
+	}
+
+	add := func(from, to int) {
+		err := s.WithTx(func(tx *StreamTx) error {
+			for i := from; i < to; i++ {
+				if err := tx.Add(base.Add(time.Second*time.Duration(i)), value(i)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the points that are left have to be the last ones, with no gaps
+	check := func(min, max uint64, last int) {
+		n := s.Count()
+		if n < min || n > max {
+			t.Errorf("expected between %d and %d points, got %d", min, max, n)
+		}
+
+		i := last + 1 - int(n)
+		for it := s.Iterator(); it.Good(); it.Next() {
+			if it.Value != value(i) || !it.Time.Equal(base.Add(time.Second*time.Duration(i))) {
+				t.Errorf("expected %d at %d, got %d at %s", value(i), i, it.Value, it.Time)
+			}
+
+			i++
+		}
+
+		if i != last+1 {
+			t.Errorf("expected the last point to be %d, got %d", last, i-1)
+		}
+	}
+
+	add(0, 1000)
+
+	blocks := len(s.chain)
+	if blocks < 3 {
+		t.Fatalf("expected at least 3 blocks, got %d", blocks)
+	}
+
+	// whole blocks are dropped, so a few more points than the limit are kept
+	if err := s.SetRetention(Retention{MaxPoints: 300}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.chain) >= blocks {
+		t.Errorf("expected fewer than %d blocks, got %d", blocks, len(s.chain))
+	}
+
+	check(300, 999, 999)
+
+	// the dropped blocks become free once the index stops referring to them
+	if len(db.pending) == 0 {
+		t.Errorf("expected the dropped blocks to be released")
+	}
+
+	// the limits are kept, and applied whenever a transaction is committed
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err = db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := s.Retention(); r != (Retention{MaxPoints: 300}) {
+		t.Errorf("expected the retention to be kept, got %v", r)
+	}
+
+	check(300, 999, 999)
+
+	add(1000, 3000)
+	check(300, 2999, 2999)
+
+	if s.Count() > 2000 {
+		t.Errorf("expected old points to be dropped, got %d", s.Count())
+	}
+
+	// ages are measured back from the last point
+	if err := s.SetRetention(Retention{MaxAge: time.Minute * 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	add(3000, 6000)
+	check(300, 2999, 5999)
+
+	// so a stream that's stopped getting points keeps the ones it has, even
+	// when they're all much older than the limit
+	n := s.Count()
+
+	if err := s.SetRetention(Retention{MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Count() != n {
+		t.Errorf("expected %d points to be kept, got %d", n, s.Count())
+	}
+
+	if err := s.SetRetention(Retention{MaxAge: -time.Second}); err != ERR_BAD_RETENTION {
+		t.Errorf("expected ERR_BAD_RETENTION, got %v", err)
+	}
+
+	if problems, err := db.Verify(); err != nil {
+		t.Error(err)
+	} else if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
+
+func TestDatabaseOutOfOrder(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("compact.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	add := func(seconds ...int) error {
+		return s.WithTx(func(tx *StreamTx) error {
+			for _, i := range seconds {
+				if err := tx.Add(base.Add(time.Second*time.Duration(i)), int64(i)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	var seconds []int
+	for i := 0; i < 100; i++ {
+		seconds = append(seconds, i*10)
+	}
+
+	if err := add(seconds...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := add(5); err == nil {
+		t.Errorf("expected a point out of order to be refused")
+	}
+
+	if err := s.SetOutOfOrder(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// a late point at the same time as another comes after it
+	if err := add(985, 5, -5, 20, 15); err != nil {
+		t.Fatal(err)
+	}
+
+	// and cancelling a transaction drops its late points
+	err = s.WithTx(func(tx *StreamTx) error {
+		if err := tx.Add(base.Add(time.Second*25), 25); err != nil {
+			return err
+		}
+
+		return stackerr.New("cancelled")
+	})
+	if err == nil {
+		t.Fatal("expected the transaction to be cancelled")
+	}
+
+	expected := []int{-5, 0, 5, 10, 15, 20, 20}
+	for i := 3; i < 99; i++ {
+		expected = append(expected, i*10)
+	}
+	expected = append(expected, 985, 990)
+
+	check := func(s *Stream) {
+		var got []int
+		for it := s.Iterator(); it.Good(); it.Next() {
+			if !it.Time.Equal(base.Add(time.Second * time.Duration(it.Value))) {
+				t.Errorf("expected %d at %s, got %s", it.Value, base.Add(time.Second*time.Duration(it.Value)), it.Time)
+			}
+
+			got = append(got, int(it.Value))
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+
+		if n := s.Count(); n != uint64(len(expected)) {
+			t.Errorf("expected %d points, got %d", len(expected), n)
+		}
+
+		if first, last, err := s.Range(); err != nil {
+			t.Error(err)
+		} else if !first.Equal(base.Add(-time.Second*5)) || !last.Equal(base.Add(time.Second*990)) {
+			t.Errorf("expected a range from -5 to 990 seconds, got %s to %s", first, last)
+		}
+
+		it := s.Iterator()
+		if err := it.Seek(base.Add(time.Second * 12)); err != nil {
+			t.Error(err)
+		} else if !it.Good() || it.Value != 15 {
+			t.Errorf("expected to seek to 15, got %v", it.Value)
+		}
+
+		sum := 0.0
+		for _, v := range expected {
+			sum += float64(v)
+		}
+
+		if buckets, err := s.Aggregate(time.Time{}, time.Time{}, 0, Aggregation{Func: AGGREGATE_SUM}); err != nil {
+			t.Error(err)
+		} else if len(buckets) != 1 || buckets[0].Value != sum || !buckets[0].Start.Equal(base.Add(-time.Second*5)) {
+			t.Errorf("expected one bucket from -5 seconds with a sum of %v, got %v", sum, buckets)
+		}
+	}
+
+	check(s)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s, err = db.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.OutOfOrder() || len(s.late) != 5 {
+		t.Errorf("expected the late points to be kept, got %d", len(s.late))
+	}
+
+	check(s)
+
+	if problems, err := db.Verify(); err != nil {
+		t.Error(err)
+	} else if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+
+	// compacting merges the late points into the blocks
+	if _, err := db.Compact("compact.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := Open("compact.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer compacted.Close()
+
+	c, err := compacted.Stream(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.OutOfOrder() || len(c.late) != 0 {
+		t.Errorf("expected the late points to be merged, got %d", len(c.late))
+	}
+
+	check(c)
+
+	// there's a limit on how many late points a stream can hold
+	err = s.WithTx(func(tx *StreamTx) error {
+		for i := 0; i <= MAXIMUM_LATE_POINTS; i++ {
+			if err := tx.Add(base, 0); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if cause(err) != ERR_TOO_MANY_LATE_POINTS {
+		t.Errorf("expected ERR_TOO_MANY_LATE_POINTS, got %v", err)
+	}
+}
+
+func TestDatabaseDuplicates(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("compact.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+
+	add := func(s *Stream, points ...int) error {
+		return s.WithTx(func(tx *StreamTx) error {
+			for i := 0; i < len(points); i += 2 {
+				if err := tx.Add(base.Add(time.Second*time.Duration(points[i])), int64(points[i+1])); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	values := func(s *Stream) []int64 {
+		var vs []int64
+		for it := s.Iterator(); it.Good(); it.Next() {
+			vs = append(vs, it.Value)
+		}
+
+		return vs
+	}
+
+	tests := []struct {
+		name     string
+		expected []int64
+		err      error
+	}{
+		{"all", []int64{0, 1, 2, 20, 21, 3}, nil},
+		{"last", []int64{0, 1, 21, 3}, nil},
+		{"first", []int64{0, 1, 2, 3}, nil},
+		{"error", []int64{0, 1, 2, 3}, ERR_DUPLICATE_TIME},
+	}
+
+	for _, test := range tests {
+		s, err := db.Stream([]byte(test.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := ParseDuplicatePolicy(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetDuplicates(p); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := add(s, 0, 0, 1, 1, 2, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		// the same time as the last point, in a new transaction and then in the
+		// same one
+		if err := add(s, 2, 20, 2, 21); err != test.err && (err == nil || cause(err) != test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+
+		if err := add(s, 3, 3); err != nil {
+			t.Fatal(err)
+		}
+
+		if vs := values(s); !reflect.DeepEqual(vs, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, vs)
+		}
+
+		sum := 0.0
+		for _, v := range test.expected {
+			sum += float64(v)
+		}
+
+		if buckets, err := s.Aggregate(time.Time{}, time.Time{}, 0, Aggregation{Func: AGGREGATE_SUM}); err != nil {
+			t.Error(err)
+		} else if len(buckets) != 1 || buckets[0].Value != sum || buckets[0].Count != uint64(len(test.expected)) {
+			t.Errorf("%s: expected a sum of %v, got %v", test.name, sum, buckets)
+		}
+	}
+
+	// late points are checked against the points that the stream already has
+	s, err := db.Stream([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetOutOfOrder(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := add(s, 1, 10, 2, 20, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if vs := values(s); !reflect.DeepEqual(vs, []int64{0, 1, 2, 3}) {
+		t.Errorf("expected a replayed batch to be ignored, got %v", vs)
+	}
+
+	if _, err := ParseDuplicatePolicy("some"); err != ERR_BAD_DUPLICATE_POLICY {
+		t.Errorf("expected ERR_BAD_DUPLICATE_POLICY, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// compacting drops the points that were replaced
+	if _, err := db.Compact("compact.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := Open("compact.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer compacted.Close()
+
+	for _, test := range tests {
+		for _, db := range []*Database{db, compacted} {
+			s, err := db.Stream([]byte(test.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p := s.Duplicates().String(); p != test.name {
+				t.Errorf("expected the %s policy to be kept, got %s", test.name, p)
+			}
+
+			if vs := values(s); !reflect.DeepEqual(vs, test.expected) {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, vs)
+			}
+		}
+	}
+
+	if s, err := compacted.Stream([]byte("last")); err != nil {
+		t.Fatal(err)
+	} else if n := s.Count(); n != 4 {
+		t.Errorf("expected 4 points after compacting, got %d", n)
+	}
+}
+
+func TestDatabaseCompactDuplicates(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("compact.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	base := time.Unix(1400000000, 0)
+
+	// points at the same time that were added before the policy was set are
+	// kept as they are, rather than refused or dropped
+	policies := []DuplicatePolicy{DUPLICATES_ERROR, DUPLICATES_KEEP_FIRST}
+
+	for _, p := range policies {
+		s, err := db.Stream([]byte(p.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.WithTx(func(tx *StreamTx) error {
+			for i, v := range []int64{1, 2, 3} {
+				if err := tx.Add(base.Add(time.Second*time.Duration(i/2)), v); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetDuplicates(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.Compact("compact.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := Open("compact.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer compacted.Close()
+
+	for _, p := range policies {
+		s, err := compacted.Stream([]byte(p.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d := s.Duplicates(); d != p {
+			t.Errorf("expected the %s policy to be kept, got %s", p, d)
+		}
+
+		var vs []int64
+		for it := s.Iterator(); it.Good(); it.Next() {
+			vs = append(vs, it.Value)
+		}
+
+		if !reflect.DeepEqual(vs, []int64{1, 2, 3}) {
+			t.Errorf("%s: expected [1 2 3], got %v", p, vs)
+		}
+
+		// and the policy applies to new points
+		err = s.WithTx(func(tx *StreamTx) error { return tx.Add(base.Add(time.Second), 4) })
+		if p == DUPLICATES_ERROR && (err == nil || cause(err) != ERR_DUPLICATE_TIME) {
+			t.Errorf("expected ERR_DUPLICATE_TIME, got %v", err)
+		} else if p == DUPLICATES_KEEP_FIRST && (err != nil || s.Count() != 3) {
+			t.Errorf("expected the new point to be ignored, got %v and %d points", err, s.Count())
+		}
+	}
+}
+
+func TestDatabaseTombstones(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("compact.db")
+
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Stream([]byte("some.stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1400000000, 0)
+	at := func(i int) time.Time {
+		return base.Add(time.Second * time.Duration(i))
+	}
+
+	// enough points, that don't compress too well, to need a few blocks
+	expected := make(map[int64]int64)
+
+	err = s.WithTx(func(tx *StreamTx) error {
+		for i := 0; i < 2000; i++ {
+			if err := tx.Add(at(i), int64(i*i%1000)); err != nil {
+				return err
+			}
+
+			expected[at(i).Unix()] = int64(i * i % 1000)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.chain) < 2 {
+		t.Fatalf("expected more than one block, got %d", len(s.chain))
+	}
+
+	check := func(s *Stream, what string) {
+		got := make(map[int64]int64)
+		for it := s.Iterator(); it.Good(); it.Next() {
+			if _, ok := got[it.Time.Unix()]; ok {
+				t.Errorf("%s: got more than one point at %s", what, it.Time)
+			}
+
+			got[it.Time.Unix()] = it.Value
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %d points, got %d", what, len(expected), len(got))
+		}
+	}
+
+	err = s.WithTx(func(tx *StreamTx) error {
+		if err := tx.DeleteRange(at(100), at(1199)); err != nil {
+			return err
+		}
+
+		if err := tx.Update(at(1500), -1); err != nil {
+			return err
+		}
+
+		// points added after a deletion aren't covered by it, even at the same
+		// time as the last point
+		if err := tx.DeleteRange(at(1999), at(2000)); err != nil {
+			return err
+		}
+
+		return tx.Add(at(1999), 7)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 100; i < 1200; i++ {
+		delete(expected, at(i).Unix())
+	}
+
+	expected[at(1500).Unix()] = -1
+	expected[at(1999).Unix()] = 7
+
+	check(s, "deleted")
+
+	// points can only be updated if they're there
+	for _, i := range []int{150, 3000} {
+		if err := s.WithTx(func(tx *StreamTx) error { return tx.Update(at(i), 1) }); err == nil || cause(err) != ERR_NO_POINT {
+			t.Errorf("expected ERR_NO_POINT at %d, got %v", i, err)
+		}
+	}
+
+	// cancelling puts the points back
+	tx := s.Tx()
+	if err := tx.DeleteRange(at(0), at(2000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+
+	check(s, "cancelled")
+
+	if err := s.WithTx(func(tx *StreamTx) error { return tx.DeleteRange(at(0), at(9)) }); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		delete(expected, at(i).Unix())
+	}
+
+	if first, last, err := s.Range(); err != nil {
+		t.Fatal(err)
+	} else if !first.Equal(at(10)) || !last.Equal(at(1999)) {
+		t.Errorf("expected a range of %s to %s, got %s to %s", at(10), at(1999), first, last)
+	}
+
+	var sum float64
+	for _, v := range expected {
+		sum += float64(v)
+	}
+
+	if buckets, err := s.Aggregate(time.Time{}, time.Time{}, 0, Aggregation{Func: AGGREGATE_SUM}); err != nil {
+		t.Error(err)
+	} else if len(buckets) != 1 || buckets[0].Value != sum || buckets[0].Count != uint64(len(expected)) {
+		t.Errorf("expected a sum of %v over %d points, got %v", sum, len(expected), buckets)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if s, err = db.Stream([]byte("some.stream")); err != nil {
+		t.Fatal(err)
+	}
+
+	check(s, "reopened")
+
+	if problems, err := db.Verify(); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+
+	// compacting removes the points for good
+	if _, err := db.Compact("compact.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := Open("compact.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer compacted.Close()
+
+	if s, err = compacted.Stream([]byte("some.stream")); err != nil {
+		t.Fatal(err)
+	}
+
+	check(s, "compacted")
+
+	if n := s.Count(); n != uint64(len(expected)) {
+		t.Errorf("expected %d points after compacting, got %d", len(expected), n)
+	}
+
+	if d := compacted.root(s.id).property(PROPERTY_TOMBSTONES); d != nil {
+		t.Errorf("expected the tombstones to be removed, got %v", d)
+	}
+
+	// points that were deleted don't count as duplicates, so they can be added
+	// again
+	for _, p := range []DuplicatePolicy{DUPLICATES_ERROR, DUPLICATES_KEEP_FIRST} {
+		s, err := db.Stream([]byte(p.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetDuplicates(p); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range []func(tx *StreamTx) error{
+			func(tx *StreamTx) error { return tx.Add(at(0), 1) },
+			func(tx *StreamTx) error { return tx.Add(at(1), 2) },
+			func(tx *StreamTx) error { return tx.DeleteRange(at(0), at(1)) },
+			func(tx *StreamTx) error { return tx.Add(at(1), 3) },
+		} {
+			if err := s.WithTx(f); err != nil {
+				t.Errorf("%s: %v", p, err)
+			}
+		}
+
+		var vs []int64
+		for it := s.Iterator(); it.Good(); it.Next() {
+			vs = append(vs, it.Value)
+		}
+
+		if !reflect.DeepEqual(vs, []int64{3}) {
+			t.Errorf("%s: expected [3], got %v", p, vs)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package jikan
+
+import (
+	"errors"
+	"time"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// DuplicatePolicy is what a stream does with a point at the same time as one
+// that it already has.
+type DuplicatePolicy uint8
+
+const (
+	// DUPLICATES_KEEP_ALL keeps both points, one after the other.
+	DUPLICATES_KEEP_ALL DuplicatePolicy = iota
+
+	// DUPLICATES_KEEP_LAST replaces the point that the stream has with the new
+	// one. Both are stored until the database is compacted, but only the new
+	// one is ever read back.
+	DUPLICATES_KEEP_LAST
+
+	// DUPLICATES_KEEP_FIRST ignores the new point.
+	DUPLICATES_KEEP_FIRST
+
+	// DUPLICATES_ERROR refuses the new point with ERR_DUPLICATE_TIME.
+	DUPLICATES_ERROR
+)
+
+var duplicatePolicyNames = []string{"all", "last", "first", "error"}
+
+var (
+	ERR_BAD_DUPLICATE_POLICY = errors.New("unknown duplicate policy")
+	ERR_DUPLICATE_TIME       = errors.New("stream already has a point at that time")
+)
+
+// ParseDuplicatePolicy turns the name of a policy ("all", "last", "first" or
+// "error") into a DuplicatePolicy.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	for i, name := range duplicatePolicyNames {
+		if name == s {
+			return DuplicatePolicy(i), nil
+		}
+	}
+
+	return 0, ERR_BAD_DUPLICATE_POLICY
+}
+
+func (p DuplicatePolicy) String() string {
+	if p.valid() {
+		return duplicatePolicyNames[p]
+	}
+
+	return "unknown"
+}
+
+func (p DuplicatePolicy) valid() bool {
+	return p <= DUPLICATES_ERROR
+}
+
+// Duplicates returns what the stream does with points at the same time as one
+// that it already has.
+func (s *Stream) Duplicates() DuplicatePolicy {
+	return s.duplicates
+}
+
+// SetDuplicates sets what the stream does with points at the same time as one
+// that it already has, which lets imports be replayed without doubling up
+// their points. It only applies to points added from now on.
+//
+// Streams that keep the last point can't use block summaries to aggregate, as
+// the summaries might include points that have been replaced, and Count
+// includes the replaced points until the database is compacted.
+func (s *Stream) SetDuplicates(p DuplicatePolicy) error {
+	log.Debugf("setting duplicate policy of `%s' to %s\n", s.id, p)
+
+	if !p.valid() {
+		return ERR_BAD_DUPLICATE_POLICY
+	}
+
+	var d []byte
+	if p != DUPLICATES_KEEP_ALL {
+		d = []byte{byte(p)}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.withRoot(func(root *dbRoot) error {
+		root.setProperty(PROPERTY_DUPLICATES, d)
+
+		return nil
+	})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if err := s.db.writeAndSwapHeader(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	s.duplicates = p
+
+	return nil
+}
+
+// duplicate reports whether the stream already has a point at t, which has
+// been truncated to the stream's precision. points can only be at the same
+// time as the last one, unless they're late, in which case the block that t
+// falls in has to be decoded. so does the last one, if it might have been
+// deleted.
+func (s *Stream) duplicate(t time.Time) (bool, error) {
+	if s.head.count == 0 || t.After(s.head.time) {
+		return false, nil
+	}
+
+	if t.Equal(s.head.time) && len(s.tombstones) == 0 {
+		return true, nil
+	}
+
+	it := s.Iterator()
+	if err := it.Seek(t); err != nil {
+		return false, stackerr.Wrap(err)
+	}
+
+	return it.Good() && it.Time.Equal(t), nil
+}
+
+// duplicates is stored in the index as a single byte, and only for streams
+// that don't keep all of them.
+
+func decodeDuplicates(d []byte) (DuplicatePolicy, bool) {
+	if len(d) != 1 || !DuplicatePolicy(d[0]).valid() {
+		return DUPLICATES_KEEP_ALL, false
+	}
+
+	return DuplicatePolicy(d[0]), true
+}
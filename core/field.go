@@ -0,0 +1,162 @@
+package jikan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A Field is one of the values in each point of a stream. Most streams have a
+// single field, named DEFAULT_FIELD, but a stream can be created with several,
+// which all share the same times.
+type Field struct {
+	Name string
+	Type ValueType
+}
+
+const (
+	DEFAULT_FIELD = "value"
+
+	// the first field's type is kept in its own byte in each block header, and
+	// the rest in a 32 bit mask, so that's as many as a block can hold
+	MAXIMUM_FIELDS = 32
+)
+
+var (
+	ERR_BAD_FIELDS        = errors.New("a stream needs between 1 and 32 fields, with unique names")
+	ERR_WRONG_FIELD_COUNT = errors.New("number of values doesn't match the fields of the stream")
+)
+
+// validFields reports whether a list of fields can be used for a new stream.
+func validFields(fields []Field) bool {
+	if len(fields) == 0 || len(fields) > MAXIMUM_FIELDS {
+		return false
+	}
+
+	names := make(map[string]bool)
+
+	for _, f := range fields {
+		if f.Name == "" || len(f.Name) > 0xffff || names[f.Name] || !f.Type.valid() {
+			return false
+		}
+
+		names[f.Name] = true
+	}
+
+	return true
+}
+
+// equalFields reports whether two lists of fields are the same.
+func equalFields(a, b []Field) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// equalTypes reports whether two lists of types are the same.
+func equalTypes(a, b []ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fieldTypes returns the type of each field.
+func fieldTypes(fields []Field) []ValueType {
+	types := make([]ValueType, len(fields))
+
+	for i, f := range fields {
+		types[i] = f.Type
+	}
+
+	return types
+}
+
+// fieldsFromTypes makes up a list of fields for values of the given types, for
+// when their names aren't known. a single field gets the default name.
+func fieldsFromTypes(types []ValueType) []Field {
+	if len(types) == 1 {
+		return []Field{{Name: DEFAULT_FIELD, Type: types[0]}}
+	}
+
+	fields := make([]Field, len(types))
+
+	for i, t := range types {
+		fields[i] = Field{Name: fmt.Sprintf("field%d", i), Type: t}
+	}
+
+	return fields
+}
+
+// a schema is stored in the index as a field count, then the type, name length
+// and name of each field:
+//
+//   0   field count
+//   1   type of the first field
+//   2   length of its name (uint16)
+//   4   name
+//   ... and so on for the rest
+
+func encodeSchema(fields []Field) []byte {
+	d := []byte{byte(len(fields))}
+
+	for _, f := range fields {
+		var buf [3]byte
+
+		buf[0] = byte(f.Type)
+		binary.BigEndian.PutUint16(buf[1:3], uint16(len(f.Name)))
+
+		d = append(d, buf[:]...)
+		d = append(d, f.Name...)
+	}
+
+	return d
+}
+
+func decodeSchema(d []byte) ([]Field, bool) {
+	if len(d) < 1 {
+		return nil, false
+	}
+
+	fields := make([]Field, int(d[0]))
+
+	o := 1
+	for i := range fields {
+		if o+3 > len(d) {
+			return nil, false
+		}
+
+		n := int(binary.BigEndian.Uint16(d[o+1 : o+3]))
+		if o+3+n > len(d) {
+			return nil, false
+		}
+
+		fields[i] = Field{
+			Name: string(d[o+3 : o+3+n]),
+			Type: ValueType(d[o]),
+		}
+
+		o += 3 + n
+	}
+
+	if o != len(d) || !validFields(fields) {
+		return nil, false
+	}
+
+	return fields, true
+}
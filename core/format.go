@@ -0,0 +1,103 @@
+package jikan
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// every database starts with a signature: six bytes of magic, followed by the
+// format version as a big-endian uint16. files from before the signature was
+// added are treated as version 0, and their header starts at offset 0.
+//
+// version history:
+//
+//   0  no signature
+//   1  signature added
+//   2  checksums on header pages and the index, and a pending free list
+//   3  time precision in block headers
+//   4  stream properties in the index, and more than one field per point
+//   5  an index of stream labels
+//   6  summaries of the first field in block headers
+const (
+	SIGNATURE        = "JIKAN\x00"
+	SIGNATURE_LENGTH = 8
+
+	FORMAT_VERSION = 6
+)
+
+var (
+	ERR_BAD_SIGNATURE       = errors.New("not a jikan database (or one from an older version that needs upgrading)")
+	ERR_NEEDS_UPGRADE       = errors.New("database is in an older format and needs upgrading")
+	ERR_UNSUPPORTED_VERSION = errors.New("database is in a newer format than this version supports")
+)
+
+var CRC_TABLE = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError is returned when some part of a database fails verification,
+// and there's no intact copy of it to fall back on.
+type CorruptionError struct {
+	Position uint64
+	What     string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt %s at offset %d", e.What, e.Position)
+}
+
+// Upgrade converts a database in an older format to the current one. The data
+// is copied into a new file, which then replaces the original. It returns the
+// version that the database was in before upgrading.
+func Upgrade(filename string) (uint16, error) {
+	log.Debugf("upgrading `%s'\n", filename)
+
+	if _, err := os.Stat(filename); err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+
+	db, err := open(filename, FORMAT_VERSION)
+	if err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+
+	version := db.version
+
+	if version == FORMAT_VERSION {
+		log.Debugf("already at version %d\n", version)
+
+		return version, stackerr.Wrap(db.close())
+	}
+
+	if version > FORMAT_VERSION {
+		db.close()
+		return version, ERR_UNSUPPORTED_VERSION
+	}
+
+	if err := db.load(); err != nil {
+		db.close()
+		return version, stackerr.Wrap(err)
+	}
+
+	tmp := filename + ".upgrade"
+
+	if _, err := db.Compact(tmp); err != nil {
+		db.Close()
+		return version, stackerr.Wrap(err)
+	}
+
+	if err := db.Close(); err != nil {
+		return version, stackerr.Wrap(err)
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return version, stackerr.Wrap(err)
+	}
+
+	log.Debugf("upgraded from version %d to %d\n", version, FORMAT_VERSION)
+
+	return version, nil
+}
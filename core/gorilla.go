@@ -0,0 +1,297 @@
+package jikan
+
+import (
+	"encoding/binary"
+)
+
+// in a gorilla block, the data area is a stream of bits, written from
+// the most significant bit of each byte down. each point is the difference
+// between its time delta and the one before it, in one of these forms:
+//
+//   0                       no difference
+//   10   + 7 bits           -64 to 63
+//   110  + 9 bits           -256 to 255
+//   1110 + 12 bits          -2048 to 2047
+//   1111 + 64 bits          anything else
+//
+// followed by a value delta for each field: a single 0 bit if the value
+// hasn't changed, or a 1 bit and the delta, encoded as in a record (see
+// putDelta), eight bits at a time.
+//
+// the first point in a block is relative to the unix epoch, and the second is
+// taken to follow a delta of zero, so that the size of the first doesn't
+// matter. the end of the data isn't marked, so the point count is used to
+// know when to stop.
+
+// the most bits that a single point can take up
+const MAXIMUM_DOD_BITS = 4 + 64 + MAXIMUM_FIELDS*(1+8*binary.MaxVarintLen64)
+
+var dodBuckets = []struct {
+	prefix uint64
+	length uint
+	bits   uint
+}{
+	{0x2, 2, 7},
+	{0x6, 3, 9},
+	{0xe, 4, 12},
+}
+
+func putDod(w *bitWriter, types []ValueType, dod int64, vdeltas []int64) {
+	if dod == 0 {
+		w.write(0, 1)
+	} else {
+		done := false
+
+		for _, b := range dodBuckets {
+			if dod >= -1<<(b.bits-1) && dod < 1<<(b.bits-1) {
+				w.write(b.prefix, b.length)
+				w.write(uint64(dod), b.bits)
+				done = true
+				break
+			}
+		}
+
+		if !done {
+			w.write(0xf, 4)
+			w.write(uint64(dod), 64)
+		}
+	}
+
+	for i, typ := range types {
+		if vdeltas[i] == 0 {
+			w.write(0, 1)
+			continue
+		}
+
+		var buf [binary.MaxVarintLen64]byte
+
+		w.write(1, 1)
+		for _, c := range buf[:typ.putDelta(buf[:], vdeltas[i])] {
+			w.write(uint64(c), 8)
+		}
+	}
+}
+
+func readDod(r *bitReader, types []ValueType, vdeltas []int64) (dod int64, ok bool) {
+	var length uint
+
+	for length < 4 {
+		bit, ok := r.read(1)
+		if !ok {
+			return 0, false
+		}
+
+		if bit == 0 {
+			break
+		}
+
+		length++
+	}
+
+	bits := uint(64)
+	switch length {
+	case 0:
+		bits = 0
+	case 1, 2, 3:
+		bits = dodBuckets[length-1].bits
+	}
+
+	if bits > 0 {
+		x, ok := r.read(bits)
+		if !ok {
+			return 0, false
+		}
+
+		// sign extend
+		dod = int64(x<<(64-bits)) >> (64 - bits)
+	}
+
+	for i, typ := range types {
+		if vdeltas[i], ok = readValueDelta(r, typ); !ok {
+			return 0, false
+		}
+	}
+
+	return dod, true
+}
+
+// readValueDelta reads a single value delta, including the bit that says
+// whether there is one.
+func readValueDelta(r *bitReader, typ ValueType) (int64, bool) {
+	changed, ok := r.read(1)
+	if !ok {
+		return 0, false
+	}
+
+	if changed == 0 {
+		return 0, true
+	}
+
+	// the encoded delta has to be read a byte at a time, since its length is
+	// only known from what's already been read
+	var buf [binary.MaxVarintLen64]byte
+	for n := 0; n < len(buf); n++ {
+		c, ok := r.read(8)
+		if !ok {
+			return 0, false
+		}
+
+		buf[n] = byte(c)
+
+		if vdelta, u := typ.readDelta(buf[:n+1]); u > 0 {
+			return vdelta, true
+		} else if u < 0 {
+			return 0, false
+		}
+	}
+
+	return 0, false
+}
+
+// gorillaCodec keeps the length of the data in bits in State.Offset, and the
+// time delta that the next point's is relative to in State.TDelta.
+type gorillaCodec struct{}
+
+func (gorillaCodec) Name() string {
+	return "gorilla"
+}
+
+// Append merges the new bits into the last byte of the data, which may only be
+// partly used. readers stop at the point count, so they never see the bits
+// past the end.
+func (gorillaCodec) Append(b *BlockData, tdelta int64, vdeltas []int64) error {
+	s := &b.State
+
+	var buf [MAXIMUM_DOD_BITS/8 + 2]byte
+
+	phase := s.Offset % 8
+
+	w := bitWriter{buf: buf[:], pos: phase}
+	putDod(&w, b.Types, tdelta-s.TDelta, vdeltas)
+
+	end := s.Offset - phase + w.pos
+	used := uint32((end + 7) / 8)
+
+	if used >= uint32(len(b.Data)) {
+		return ERR_BLOCK_FULL
+	}
+
+	o := uint32(s.Offset / 8)
+
+	buf[0] |= b.Data[o] &^ (0xff >> phase)
+	copy(b.Data[o:used], buf[:used-o])
+
+	b.Used = used
+
+	s.Offset = end
+	s.TDelta = tdelta
+	if b.Count == 0 {
+		s.TDelta = 0
+	}
+
+	return nil
+}
+
+func (c gorillaCodec) Resume(b *BlockData) error {
+	d := c.Decoder(b).(*gorillaDecoder)
+	vdeltas := make([]int64, len(b.Types))
+
+	for d.More() {
+		if _, _, err := d.Next(vdeltas); err != nil {
+			return err
+		}
+	}
+
+	b.State.Offset = d.r.pos
+	b.State.TDelta = d.tdelta
+
+	return nil
+}
+
+func (gorillaCodec) Decoder(b *BlockData) Decoder {
+	return &gorillaDecoder{
+		r:     bitReader{buf: b.Data[:b.Used]},
+		types: b.Types,
+		count: b.Count,
+	}
+}
+
+type gorillaDecoder struct {
+	r      bitReader
+	types  []ValueType
+	count  uint32
+	seen   uint32
+	tdelta int64
+}
+
+func (d *gorillaDecoder) More() bool {
+	return d.seen < d.count
+}
+
+func (d *gorillaDecoder) Next(vdeltas []int64) (uint32, int64, error) {
+	r := d.r
+
+	dod, ok := readDod(&r, d.types, vdeltas)
+	if !ok {
+		return 0, 0, ERR_BAD_RECORD
+	}
+
+	d.r = r
+
+	tdelta := d.tdelta + dod
+
+	// the first point's delta is from the epoch, so it's no use as a base for
+	// the second
+	d.tdelta = tdelta
+	if d.seen == 0 {
+		d.tdelta = 0
+	}
+
+	d.seen++
+
+	return 1, tdelta, nil
+}
+
+func (d *gorillaDecoder) Offset() uint64 {
+	return d.r.pos / 8
+}
+
+// bitWriter writes bits into a buffer, starting pos bits in.
+type bitWriter struct {
+	buf []byte
+	pos uint64
+}
+
+func (w *bitWriter) write(x uint64, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		mask := byte(0x80) >> (w.pos % 8)
+
+		if x>>uint(i)&1 == 1 {
+			w.buf[w.pos/8] |= mask
+		} else {
+			w.buf[w.pos/8] &^= mask
+		}
+
+		w.pos++
+	}
+}
+
+// bitReader reads bits from a buffer, starting pos bits in.
+type bitReader struct {
+	buf []byte
+	pos uint64
+}
+
+func (r *bitReader) read(n uint) (uint64, bool) {
+	if r.pos+uint64(n) > uint64(len(r.buf))*8 {
+		return 0, false
+	}
+
+	var x uint64
+	for i := uint(0); i < n; i++ {
+		x = x<<1 | uint64(r.buf[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+
+	return x, true
+}
@@ -0,0 +1,188 @@
+package jikan
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// a latePoint is a point that arrived after a later one, so it couldn't be
+// added to the end of the stream's blocks. vs holds the values as they're
+// stored.
+type latePoint struct {
+	t  time.Time
+	vs []int64
+}
+
+// MAXIMUM_LATE_POINTS is the most points that a stream can hold out of order.
+// They're kept in the index, so there can't be too many of them.
+const MAXIMUM_LATE_POINTS = 4096
+
+var (
+	ERR_TOO_MANY_LATE_POINTS = errors.New("too many points out of order; compact the database to merge them in")
+)
+
+// OutOfOrder reports whether the stream takes points that are older than its
+// last one.
+func (s *Stream) OutOfOrder() bool {
+	return s.outOfOrder
+}
+
+// SetOutOfOrder sets whether the stream takes points that are older than its
+// last one. Normally, adding one is an error. When this is set, they're kept
+// to one side, in the index, until the database is compacted, which merges
+// them into the blocks. Until then, iterators return them in order with the
+// rest, but aggregations and rollups have to decode every point in any range
+// that has one in it, and rollups leave out any that arrive after their step
+// has been rolled up.
+//
+// A stream can only hold MAXIMUM_LATE_POINTS of them at a time. Turning this
+// off keeps any that the stream already has.
+func (s *Stream) SetOutOfOrder(enabled bool) error {
+	log.Debugf("setting out of order points for `%s' to %v\n", s.id, enabled)
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.outOfOrder = enabled
+
+	if err := s.writeLate(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// addLate adds a point that's older than the last one in the stream. late
+// points are kept sorted by time, with points at the same time in the order
+// that they were added. the list is copied, rather than changed in place, so
+// that iterators and transactions can keep hold of the one they started with.
+func (s *Stream) addLate(t time.Time, vs []int64) error {
+	if len(vs) != len(s.head.types) {
+		return ERR_WRONG_FIELD_COUNT
+	}
+
+	if len(s.late) >= MAXIMUM_LATE_POINTS {
+		return ERR_TOO_MANY_LATE_POINTS
+	}
+
+	t = time.Unix(0, t.Truncate(s.head.precision.Duration()).UnixNano())
+
+	log.Debugf("adding late point at %s\n", t)
+
+	n := sort.Search(len(s.late), func(k int) bool {
+		return s.late[k].t.After(t)
+	})
+
+	late := make([]latePoint, 0, len(s.late)+1)
+	late = append(late, s.late[:n]...)
+	late = append(late, latePoint{t: t, vs: append([]int64(nil), vs...)})
+	late = append(late, s.late[n:]...)
+
+	s.late = late
+
+	return nil
+}
+
+// writeLate keeps the stream's late points, and whether it takes them, in the
+// index, along with its tombstones, which can remove late points.
+func (s *Stream) writeLate() error {
+	var d []byte
+	if s.outOfOrder || len(s.late) > 0 {
+		d = encodeLate(s.outOfOrder, s.late)
+	}
+
+	var t []byte
+	if len(s.tombstones) > 0 {
+		t = encodeTombstones(s.tombstones)
+	}
+
+	err := s.withRoot(func(root *dbRoot) error {
+		root.setProperty(PROPERTY_LATE, d)
+		root.setProperty(PROPERTY_TOMBSTONES, t)
+
+		return nil
+	})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if err := s.db.writeAndSwapHeader(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// lateBetween reports whether the stream has any late points from from up to
+// (but not including) to. either can be zero, for no limit.
+func (s *Stream) lateBetween(from, to time.Time) bool {
+	n := sort.Search(len(s.late), func(k int) bool {
+		return !s.late[k].t.Before(from)
+	})
+
+	return n < len(s.late) && (to.IsZero() || s.late[n].t.Before(to))
+}
+
+// late points are stored in the index as a flag that's set if the stream takes
+// them, and then a count (uint32) and each point: its time in nanoseconds and
+// the value of each field, all as uint64s.
+
+func encodeLate(enabled bool, late []latePoint) []byte {
+	d := make([]byte, 5)
+
+	if enabled {
+		d[0] = 1
+	}
+
+	binary.BigEndian.PutUint32(d[1:5], uint32(len(late)))
+
+	for _, p := range late {
+		var buf [8]byte
+
+		binary.BigEndian.PutUint64(buf[:], uint64(p.t.UnixNano()))
+		d = append(d, buf[:]...)
+
+		for _, v := range p.vs {
+			binary.BigEndian.PutUint64(buf[:], uint64(v))
+			d = append(d, buf[:]...)
+		}
+	}
+
+	return d
+}
+
+func decodeLate(d []byte, fields int) (bool, []latePoint, bool) {
+	if len(d) < 5 || d[0] > 1 {
+		return false, nil, false
+	}
+
+	count := int(binary.BigEndian.Uint32(d[1:5]))
+	if count > MAXIMUM_LATE_POINTS || len(d) != 5+count*8*(1+fields) {
+		return false, nil, false
+	}
+
+	late := make([]latePoint, count)
+
+	o := 5
+	for i := range late {
+		late[i].t = time.Unix(0, int64(binary.BigEndian.Uint64(d[o:o+8])))
+		late[i].vs = make([]int64, fields)
+		o += 8
+
+		for k := range late[i].vs {
+			late[i].vs[k] = int64(binary.BigEndian.Uint64(d[o : o+8]))
+			o += 8
+		}
+
+		if i > 0 && late[i].t.Before(late[i-1].t) {
+			return false, nil, false
+		}
+	}
+
+	return d[0] == 1, late, true
+}
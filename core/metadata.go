@@ -0,0 +1,154 @@
+package jikan
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Metadata describes a stream. It's kept in the index, with the stream's root,
+// so it can be changed without touching the stream's data.
+type Metadata struct {
+	Labels      map[string]string
+	Unit        string
+	Description string
+}
+
+var (
+	ERR_BAD_METADATA = errors.New("metadata labels need non-empty names, and nothing can be longer than 65535 bytes")
+	ERR_BAD_LABELS   = errors.New("labels must be given as name=value pairs, separated by commas")
+)
+
+func (m Metadata) valid() bool {
+	if len(m.Labels) > 0xffff || len(m.Unit) > 0xffff || len(m.Description) > 0xffff {
+		return false
+	}
+
+	for k, v := range m.Labels {
+		if k == "" || len(k) > 0xffff || len(v) > 0xffff {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m Metadata) empty() bool {
+	return len(m.Labels) == 0 && m.Unit == "" && m.Description == ""
+}
+
+// Matches reports whether the metadata has all of the given labels, with the
+// same values.
+func (m Metadata) Matches(labels map[string]string) bool {
+	for k, v := range labels {
+		if l, ok := m.Labels[k]; !ok || l != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ParseLabels turns a list of labels like "host=web1,metric=cpu" into a map.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	if s == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ERR_BAD_LABELS
+		}
+
+		labels[kv[0]] = kv[1]
+	}
+
+	return labels, nil
+}
+
+// metadata is stored in the index as the unit, the description, and then the
+// labels, sorted by name. every string is preceded by its length as a uint16,
+// and the labels by their count.
+
+func encodeMetadata(m Metadata) []byte {
+	var d []byte
+
+	put := func(s string) {
+		var buf [2]byte
+		binary.BigEndian.PutUint16(buf[:], uint16(len(s)))
+
+		d = append(d, buf[:]...)
+		d = append(d, s...)
+	}
+
+	put(m.Unit)
+	put(m.Description)
+
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(len(keys)))
+	d = append(d, buf[:]...)
+
+	for _, k := range keys {
+		put(k)
+		put(m.Labels[k])
+	}
+
+	return d
+}
+
+func decodeMetadata(d []byte) (Metadata, bool) {
+	m := Metadata{Labels: make(map[string]string)}
+
+	o := 0
+	ok := true
+
+	get := func() string {
+		if o+2 > len(d) {
+			ok = false
+			return ""
+		}
+
+		n := int(binary.BigEndian.Uint16(d[o : o+2]))
+		if o+2+n > len(d) {
+			ok = false
+			return ""
+		}
+
+		s := string(d[o+2 : o+2+n])
+		o += 2 + n
+
+		return s
+	}
+
+	m.Unit = get()
+	m.Description = get()
+
+	if !ok || o+2 > len(d) {
+		return Metadata{}, false
+	}
+
+	count := int(binary.BigEndian.Uint16(d[o : o+2]))
+	o += 2
+
+	for i := 0; i < count && ok; i++ {
+		k := get()
+		m.Labels[k] = get()
+	}
+
+	if !ok || o != len(d) {
+		return Metadata{}, false
+	}
+
+	return m, true
+}
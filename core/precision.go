@@ -0,0 +1,72 @@
+package jikan
+
+import (
+	"errors"
+	"time"
+)
+
+// Precision is the resolution that a stream's times are stored at. Times are
+// truncated to it when they're added, so coarser precisions give smaller
+// deltas, and smaller records, at the cost of detail. It's stored in each block
+// as the number of decimal digits dropped from a nanosecond time.
+type Precision uint8
+
+const (
+	PRECISION_NANOSECOND  Precision = 0
+	PRECISION_MICROSECOND Precision = 3
+	PRECISION_MILLISECOND Precision = 6
+	PRECISION_SECOND      Precision = 9
+)
+
+var (
+	ERR_BAD_PRECISION = errors.New("unknown time precision")
+)
+
+// ParsePrecision turns a unit name ("ns", "us", "ms" or "s") into a Precision.
+func ParsePrecision(s string) (Precision, error) {
+	switch s {
+	case "ns":
+		return PRECISION_NANOSECOND, nil
+	case "us", "µs":
+		return PRECISION_MICROSECOND, nil
+	case "ms":
+		return PRECISION_MILLISECOND, nil
+	case "s":
+		return PRECISION_SECOND, nil
+	}
+
+	return 0, ERR_BAD_PRECISION
+}
+
+// Duration returns the length of one unit of the precision.
+func (p Precision) Duration() time.Duration {
+	switch p {
+	case PRECISION_MICROSECOND:
+		return time.Microsecond
+	case PRECISION_MILLISECOND:
+		return time.Millisecond
+	case PRECISION_SECOND:
+		return time.Second
+	}
+
+	return time.Nanosecond
+}
+
+func (p Precision) String() string {
+	switch p {
+	case PRECISION_NANOSECOND:
+		return "ns"
+	case PRECISION_MICROSECOND:
+		return "us"
+	case PRECISION_MILLISECOND:
+		return "ms"
+	case PRECISION_SECOND:
+		return "s"
+	}
+
+	return "unknown"
+}
+
+func (p Precision) valid() bool {
+	return p == PRECISION_NANOSECOND || p == PRECISION_MICROSECOND || p == PRECISION_MILLISECOND || p == PRECISION_SECOND
+}
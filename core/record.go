@@ -0,0 +1,203 @@
+package jikan
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// records are stored as a time delta, which is a signed varint, followed by a
+// value delta for each field, which is encoded according to the field's type
+// (see putDelta). time deltas are never negative (points are strictly
+// ordered), so a negative leading varint is used to mark a run-length encoded
+// record. in that case, the varint holds the negated repeat count and is
+// followed by the deltas that are repeated.
+//
+//   plain record: <tdelta> <vdelta>...
+//   run record:   <-count> <tdelta> <vdelta>...
+//
+// blocks written before run-length encoding existed only contain plain
+// records, so they can still be read without modification.
+//
+// a float delta is never longer than a varint, so the maximum length holds for
+// every type.
+
+const MAXIMUM_RECORD_LENGTH = binary.MaxVarintLen64 * (2 + MAXIMUM_FIELDS)
+
+var (
+	ERR_BAD_RECORD = errors.New("couldn't decode record")
+)
+
+func putRecord(buf []byte, types []ValueType, count uint32, tdelta int64, vdeltas []int64) int {
+	u := 0
+
+	if count > 1 {
+		u += binary.PutVarint(buf[u:], -int64(count))
+	}
+
+	u += binary.PutVarint(buf[u:], tdelta)
+
+	for i, typ := range types {
+		u += typ.putDelta(buf[u:], vdeltas[i])
+	}
+
+	return u
+}
+
+func readRecord(d []byte, types []ValueType, vdeltas []int64) (count uint32, tdelta int64, n int) {
+	count = 1
+
+	x, u := binary.Varint(d)
+	if u <= 0 {
+		return 0, 0, u
+	}
+
+	n += u
+
+	// a run that doesn't fit in a uint32 would wrap around, possibly to zero,
+	// which the readers would take as billions of points
+	if x < 0 {
+		if x < -math.MaxUint32 {
+			return 0, 0, -1
+		}
+
+		count = uint32(-x)
+
+		if x, u = binary.Varint(d[n:]); u <= 0 {
+			return 0, 0, u
+		}
+
+		n += u
+	}
+
+	tdelta = x
+
+	for i, typ := range types {
+		if vdeltas[i], u = typ.readDelta(d[n:]); u <= 0 {
+			return 0, 0, u
+		}
+
+		n += u
+	}
+
+	return count, tdelta, n
+}
+
+// rleCodec writes records as above, extending the last record into a run when
+// a point repeats its deltas. only records that readers can't see yet are
+// extended, so a run is never changed once it's been committed.
+type rleCodec struct{}
+
+func (rleCodec) Name() string {
+	return "rle"
+}
+
+func (rleCodec) Append(b *BlockData, tdelta int64, vdeltas []int64) error {
+	s := &b.State
+
+	if s.Count > 0 && uint32(s.Offset) >= b.Synced && tdelta == s.TDelta && equalDeltas(vdeltas, s.VDeltas[:]) {
+		if err := appendRecord(b, uint32(s.Offset), s.Count+1, tdelta, vdeltas); err != nil {
+			return err
+		}
+
+		s.Count++
+
+		return nil
+	}
+
+	o := b.Used
+
+	if err := appendRecord(b, o, 1, tdelta, vdeltas); err != nil {
+		return err
+	}
+
+	s.Offset = uint64(o)
+	s.Count = 1
+	s.TDelta = tdelta
+	copy(s.VDeltas[:], vdeltas)
+
+	return nil
+}
+
+// equalDeltas reports whether a point's value deltas are the same as the start
+// of the saved ones.
+func equalDeltas(vdeltas, saved []int64) bool {
+	for i, d := range vdeltas {
+		if saved[i] != d {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (rleCodec) Resume(b *BlockData) error {
+	// nothing that's already on disk can be extended, so there's nothing to
+	// pick up
+	return nil
+}
+
+func (rleCodec) Decoder(b *BlockData) Decoder {
+	return &recordDecoder{d: b.Data[:b.Used], types: b.Types}
+}
+
+// varintCodec writes a plain record for every point.
+type varintCodec struct{}
+
+func (varintCodec) Name() string {
+	return "varint"
+}
+
+func (varintCodec) Append(b *BlockData, tdelta int64, vdeltas []int64) error {
+	return appendRecord(b, b.Used, 1, tdelta, vdeltas)
+}
+
+func (varintCodec) Resume(b *BlockData) error {
+	return nil
+}
+
+func (varintCodec) Decoder(b *BlockData) Decoder {
+	return &recordDecoder{d: b.Data[:b.Used], types: b.Types}
+}
+
+// appendRecord writes a record at offset o in the data area, and moves the end
+// of the used space to just after it.
+func appendRecord(b *BlockData, o uint32, count uint32, tdelta int64, vdeltas []int64) error {
+	var buf [MAXIMUM_RECORD_LENGTH]byte
+	u := putRecord(buf[:], b.Types, count, tdelta, vdeltas)
+
+	if int(o)+u >= len(b.Data) {
+		return ERR_BLOCK_FULL
+	}
+
+	copy(b.Data[o:int(o)+u], buf[0:u])
+
+	b.Used = o + uint32(u)
+
+	return nil
+}
+
+type recordDecoder struct {
+	d     []byte
+	types []ValueType
+	pos   int
+}
+
+func (r *recordDecoder) More() bool {
+	return r.pos < len(r.d)
+}
+
+func (r *recordDecoder) Next(vdeltas []int64) (uint32, int64, error) {
+	count, tdelta, n := readRecord(r.d[r.pos:], r.types, vdeltas)
+	if n <= 0 {
+		return 0, 0, ERR_BAD_RECORD
+	}
+
+	r.pos += n
+
+	return count, tdelta, nil
+}
+
+func (r *recordDecoder) Offset() uint64 {
+	return uint64(r.pos)
+}
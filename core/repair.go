@@ -0,0 +1,491 @@
+package jikan
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// RepairReport describes what Repair managed to recover, and what it couldn't.
+type RepairReport struct {
+	Streams  []RepairedStream
+	Problems []Problem
+}
+
+// RepairedStream is the number of points recovered and lost from one stream.
+// Lost only counts points that were known to exist; if a block couldn't be
+// read at all, there's no way to know how many points were in it.
+type RepairedStream struct {
+	Name      []byte
+	Recovered uint64
+	Lost      uint64
+}
+
+// the stream name prefix used for chains of blocks that can't be traced back
+// to the stream that they belonged to
+const LOST_AND_FOUND = "lost+found/"
+
+// Repair copies every point that can be recovered from a damaged database into
+// a new one. Each stream's block chain is followed as far as it can be, and
+// each block is decoded up to its first bad record. Blocks that aren't reached
+// that way are found by scanning the file for valid block headers, and are
+// recovered into streams named with the LOST_AND_FOUND prefix. Scanning relies
+// on header checksums, so it's only done for format version 2 and later.
+func Repair(filename, output string) (*RepairReport, error) {
+	log.Debugf("repairing `%s' into `%s'\n", filename, output)
+
+	if _, err := os.Stat(filename); err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	if _, err := os.Stat(output); err == nil {
+		return nil, stackerr.Newf("destination `%s' already exists", output)
+	} else if !os.IsNotExist(err) {
+		return nil, stackerr.Wrap(err)
+	}
+
+	src, err := open(filename, FORMAT_VERSION)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	defer src.close()
+
+	if src.version > FORMAT_VERSION {
+		return nil, ERR_UNSUPPORTED_VERSION
+	}
+
+	var report RepairReport
+
+	problem := func(stream []byte, position uint64, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, Problem{
+			Stream:   stream,
+			Position: position,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	// without a header, there are no roots, but we can still go looking for
+	// blocks
+	if err := src.load(); err != nil {
+		problem(nil, 0, "couldn't read database header: %s", cause(err))
+
+		src.roots = nil
+		src.free = nil
+		src.pending = nil
+	}
+
+	dst, err := Open(output)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	// claimed holds every region that's known to be in use or free, so that we
+	// don't recover anything twice, or recover blocks that were deliberately
+	// freed
+	claimed := &claims{starts: make(map[uint64]bool)}
+
+	if src.index != 0 {
+		claimed.claim(src.index, src.indexLength)
+	}
+
+	for _, list := range [][]*dbFree{src.free, src.pending} {
+		for _, f := range list {
+			claimed.claim(f.position, f.length)
+		}
+	}
+
+	for _, r := range src.roots {
+		rs, err := src.repairChain(dst, r.id, r.position, r, claimed, problem)
+		if err != nil {
+			dst.Close()
+			return nil, stackerr.Wrap(err)
+		}
+
+		report.Streams = append(report.Streams, *rs)
+	}
+
+	if src.version >= 2 {
+		orphans, err := src.findOrphans(claimed)
+		if err != nil {
+			dst.Close()
+			return nil, stackerr.Wrap(err)
+		}
+
+		for _, position := range orphans {
+			if claimed.starts[position] {
+				continue
+			}
+
+			name := []byte(fmt.Sprintf("%s%d", LOST_AND_FOUND, position))
+
+			rs, err := src.repairChain(dst, name, position, nil, claimed, problem)
+			if err != nil {
+				dst.Close()
+				return nil, stackerr.Wrap(err)
+			}
+
+			report.Streams = append(report.Streams, *rs)
+		}
+	}
+
+	if err := dst.Close(); err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	return &report, nil
+}
+
+// claims are the regions of a file that repair knows what to do with. starts
+// holds where each of them starts, which is enough to tell whether a chain
+// runs into one, but blocks that were freed keep their headers, and regions
+// that were freed next to each other are joined, so scanning has to skip the
+// whole of each region.
+type claims struct {
+	starts  map[uint64]bool
+	regions []region
+}
+
+func (c *claims) claim(position, length uint64) {
+	c.starts[position] = true
+	c.regions = append(c.regions, region{position: position, length: length})
+}
+
+// merged returns the claimed regions sorted by position, with the ones that
+// overlap or touch joined together. they can overlap in a damaged file.
+func (c *claims) merged() []region {
+	regions := append([]region(nil), c.regions...)
+	sort.Sort(regionsByPosition(regions))
+
+	merged := regions[:0]
+	for _, r := range regions {
+		if n := len(merged); n > 0 && r.position <= merged[n-1].position+merged[n-1].length {
+			if end := r.position + r.length; end > merged[n-1].position+merged[n-1].length {
+				merged[n-1].length = end - merged[n-1].position
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+
+	return merged
+}
+
+// findOrphans scans the file for blocks with valid headers that aren't in any
+// of the claimed regions. the ones that no other orphan points to - that is,
+// the starts of orphaned chains - come first, followed by the rest, which only
+// matter if they're part of a chain that loops.
+func (db *Database) findOrphans(claimed *claims) ([]uint64, error) {
+	log.Debugf("scanning for orphaned blocks\n")
+
+	var found []uint64
+	next := make(map[uint64]bool)
+
+	regions := claimed.merged()
+
+	for position := db.base + headerLength(db.version); position+blockHeaderLength(db.version) <= uint64(len(db.mm)); position++ {
+		for len(regions) > 0 && regions[0].position+regions[0].length <= position {
+			regions = regions[1:]
+		}
+
+		// skip to the end of the region that position is in
+		if len(regions) > 0 && regions[0].position <= position {
+			position = regions[0].position + regions[0].length - 1
+			continue
+		}
+
+		b, err := db.getBlock(position)
+		if err != nil || b.count == 0 {
+			continue
+		}
+
+		log.Debugf("found orphaned block at %d\n", position)
+
+		found = append(found, position)
+		next[b.next] = true
+	}
+
+	var starts, rest []uint64
+	for _, position := range found {
+		if next[position] {
+			rest = append(rest, position)
+		} else {
+			starts = append(starts, position)
+		}
+	}
+
+	return append(starts, rest...), nil
+}
+
+// repairChain copies the points from a chain of blocks into a new stream in
+// dst, following it for as long as the blocks can be read. root is the stream's
+// entry in the index, or nil if the chain was found by scanning, in which case
+// its schema, metadata, retention, rollups, duplicate policy, late points and
+// tombstones are unknown.
+func (db *Database) repairChain(dst *Database, name []byte, position uint64, root *dbRoot, claimed *claims, problem func([]byte, uint64, string, ...interface{})) (*RepairedStream, error) {
+	log.Debugf("repairing stream `%s' from %d\n", name, position)
+
+	rs := RepairedStream{Name: name}
+
+	// the new stream takes its options from the first block, if it can be read
+	var schema, metadata, retention, rollups, duplicates, late, tombs []byte
+	if root != nil {
+		schema = root.property(PROPERTY_SCHEMA)
+		metadata = root.property(PROPERTY_METADATA)
+		retention = root.property(PROPERTY_RETENTION)
+		rollups = root.property(PROPERTY_ROLLUPS)
+		duplicates = root.property(PROPERTY_DUPLICATES)
+		late = root.property(PROPERTY_LATE)
+		tombs = root.property(PROPERTY_TOMBSTONES)
+	}
+
+	var options StreamOptions
+	if b, err := db.getBlock(position); err == nil {
+		options.Precision = b.precision
+		options.Type = b.types[0]
+		options.Codec = b.codecID
+
+		// the names of the fields are only kept in the index, so they're made
+		// up if it's lost
+		if fields, ok := decodeSchema(schema); ok && equalTypes(fieldTypes(fields), b.types) {
+			options.Fields = fields
+		} else if len(b.types) > 1 {
+			options.Fields = fieldsFromTypes(b.types)
+		}
+	}
+
+	types := fieldTypes(options.fields())
+
+	s, err := dst.StreamWithOptions(name, options)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	if metadata != nil {
+		if m, ok := decodeMetadata(metadata); !ok {
+			problem(name, db.index, "couldn't decode the stream's metadata")
+		} else if err := s.SetMetadata(m); err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+	}
+
+	// the duplicate policy is only set on the new stream once the points are
+	// in, since it's already been applied to them. points that were replaced
+	// under DUPLICATES_KEEP_LAST are still in the blocks, though, so they're
+	// left out as they're copied.
+	policy := DUPLICATES_KEEP_ALL
+
+	if duplicates != nil {
+		var ok bool
+		if policy, ok = decodeDuplicates(duplicates); !ok {
+			problem(name, db.index, "couldn't decode the stream's duplicate policy")
+		}
+	}
+
+	// late points are merged in with the rest, as they are when compacting, but
+	// the stream still takes them afterwards
+	var points []latePoint
+	var outOfOrder bool
+
+	if late != nil {
+		var ok bool
+		if outOfOrder, points, ok = decodeLate(late, len(types)); !ok {
+			problem(name, db.index, "couldn't decode the stream's late points")
+
+			// the flag and the count come first, so they might still be intact
+			outOfOrder = len(late) > 0 && late[0] == 1
+			if len(late) >= 5 {
+				if n := binary.BigEndian.Uint32(late[1:5]); n <= MAXIMUM_LATE_POINTS {
+					rs.Lost += uint64(n)
+				}
+			}
+		}
+	}
+
+	// the points that were deleted are left out, and the ones that were updated
+	// are replaced, as they are when compacting. tombstones are marked with a
+	// block in the chain, so the chain has to be found before it's followed.
+	var tombstones []tombstone
+	var marks []int
+
+	if tombs != nil {
+		var ok bool
+		if tombstones, ok = decodeTombstones(tombs, len(types)); !ok {
+			problem(name, db.index, "couldn't decode the stream's tombstones")
+		}
+
+		var chain []uint64
+		seen := make(map[uint64]bool)
+
+		for p := position; p != 0 && !claimed.starts[p] && !seen[p]; {
+			b, err := db.getBlock(p)
+			if err != nil {
+				break
+			}
+
+			seen[p] = true
+			chain = append(chain, p)
+			p = b.next
+		}
+
+		marks = markTombstones(tombstones, chain)
+		points = mergeLate(replacements(tombstones), points)
+	}
+
+	tx := s.Tx()
+
+	copyPoint := func(position uint64, t time.Time, vs []int64) {
+		if err := tx.add(t, vs); err != nil {
+			problem(name, position, "dropped point at %s: %s", t.Format(time.RFC3339Nano), cause(err))
+			rs.Lost++
+		} else {
+			rs.Recovered++
+		}
+	}
+
+	// with DUPLICATES_KEEP_LAST, each point is held back until the next one
+	// shows whether it was replaced, as iterators do
+	var held struct {
+		ok       bool
+		position uint64
+		t        time.Time
+		vs       []int64
+	}
+
+	add := func(position uint64, t time.Time, vs []int64) {
+		if policy != DUPLICATES_KEEP_LAST {
+			copyPoint(position, t, vs)
+			return
+		}
+
+		if held.ok && !held.t.Equal(t) {
+			copyPoint(held.position, held.t, held.vs)
+		}
+
+		held.ok = true
+		held.position = position
+		held.t = t
+		held.vs = append([]int64(nil), vs...)
+	}
+
+	// flush adds the late points from before t, or all of them if t is zero.
+	// points from the blocks go first when they're at the same time, as they do
+	// in iterators.
+	flush := func(t time.Time) {
+		for len(points) > 0 && (t.IsZero() || points[0].t.Before(t)) {
+			add(db.index, points[0].t, points[0].vs)
+			points = points[1:]
+		}
+	}
+
+	for idx := 0; position != 0; idx++ {
+		if claimed.starts[position] {
+			problem(name, position, "block chain runs into a block that's already been recovered")
+			break
+		}
+
+		b, err := db.getBlock(position)
+		if err != nil {
+			problem(name, position, "couldn't read block: %s", cause(err))
+			break
+		}
+
+		claimed.claim(position, b.size())
+
+		// a chain never mixes types, but a damaged next pointer could lead
+		// anywhere
+		if !equalTypes(b.types, types) {
+			problem(name, position, "block holds %v values, but the stream holds %v values", b.types, types)
+			rs.Lost += uint64(b.count)
+			position = b.next
+			continue
+		}
+
+		var decoded uint32
+
+		err = b.points(func(t time.Time, vs []int64) error {
+			decoded++
+
+			if buried(tombstones, marks, idx, decoded, t) {
+				return nil
+			}
+
+			flush(t)
+			add(position, t, vs)
+
+			return nil
+		})
+		if err != nil {
+			problem(name, position, "lost the rest of the block: %s", cause(err))
+
+			if b.count > decoded {
+				rs.Lost += uint64(b.count - decoded)
+			}
+		}
+
+		position = b.next
+	}
+
+	flush(time.Time{})
+
+	if held.ok {
+		copyPoint(held.position, held.t, held.vs)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	if outOfOrder {
+		if err := s.SetOutOfOrder(true); err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+	}
+
+	if policy != DUPLICATES_KEEP_ALL {
+		if err := s.SetDuplicates(policy); err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+	}
+
+	// retention and rollups are only copied once the points are in, so that
+	// neither is applied to them on the way. the stream was already kept within
+	// its limits, and the streams that it's rolled up into are repaired like
+	// any other.
+	if retention != nil {
+		if _, ok := decodeRetention(retention); !ok {
+			problem(name, db.index, "couldn't decode the stream's retention")
+			retention = nil
+		}
+	}
+
+	if rollups != nil {
+		if _, ok := decodeRollups(rollups); !ok {
+			problem(name, db.index, "couldn't decode the stream's rollups")
+			rollups = nil
+		}
+	}
+
+	if retention != nil || rollups != nil {
+		err := s.withRoot(func(root *dbRoot) error {
+			root.setProperty(PROPERTY_RETENTION, retention)
+			root.setProperty(PROPERTY_ROLLUPS, rollups)
+
+			return nil
+		})
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+
+		if err := dst.writeAndSwapHeader(); err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+	}
+
+	return &rs, nil
+}
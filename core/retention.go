@@ -0,0 +1,207 @@
+package jikan
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// Retention limits how much of a stream is kept. Points are only ever dropped
+// a whole block at a time, from the front of the stream, once every point in
+// the block is outside the limits, so a stream can keep a little more than
+// they say. The last block is never dropped. Zero means no limit.
+type Retention struct {
+	// MaxAge is how long points are kept for, measured back from the last
+	// point in the stream rather than from now, so that a stream that's stopped
+	// getting new points keeps the ones it has.
+	MaxAge time.Duration
+
+	// MaxPoints is how many points are kept.
+	MaxPoints uint64
+}
+
+var (
+	ERR_BAD_RETENTION = errors.New("retention can't have a negative maximum age")
+)
+
+func (r Retention) empty() bool {
+	return r.MaxAge == 0 && r.MaxPoints == 0
+}
+
+// Retention returns the limits on how much of the stream is kept.
+func (s *Stream) Retention() Retention {
+	s.db.RLock()
+	defer s.db.RUnlock()
+
+	return s.db.retention(s.id)
+}
+
+// SetRetention replaces the limits on how much of the stream is kept, and
+// drops any blocks that are outside them straight away. After that, they're
+// applied whenever a transaction on the stream is committed.
+//
+// Iterators that are open on the stream while blocks are dropped may miss
+// some of the points after them.
+func (s *Stream) SetRetention(r Retention) error {
+	log.Debugf("setting retention of `%s' to %s and %d points\n", s.id, r.MaxAge, r.MaxPoints)
+
+	if r.MaxAge < 0 {
+		return ERR_BAD_RETENTION
+	}
+
+	var d []byte
+	if !r.empty() {
+		d = encodeRetention(r)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.withRoot(func(root *dbRoot) error {
+		root.setProperty(PROPERTY_RETENTION, d)
+
+		return nil
+	})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if err := s.db.writeAndSwapHeader(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if err := s.retain(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// retain drops the blocks at the front of the stream that are entirely outside
+// its retention. the stream has to be locked.
+func (s *Stream) retain() error {
+	r := s.Retention()
+
+	if r.empty() {
+		return nil
+	}
+
+	var cutoff time.Time
+	if r.MaxAge > 0 && s.head.count > 0 {
+		cutoff = s.head.time.Add(-r.MaxAge)
+	}
+
+	total := s.Count()
+
+	n := 0
+	for ; n < len(s.chain)-1; n++ {
+		b := s.chain[n]
+
+		old := !cutoff.IsZero() && b.time.Before(cutoff)
+		extra := r.MaxPoints > 0 && total-uint64(b.count) >= r.MaxPoints
+
+		if !old && !extra {
+			break
+		}
+
+		total -= uint64(b.count)
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	log.Debugf("dropping %d blocks from `%s'\n", n, s.id)
+
+	// tombstones that were made while one of the dropped blocks was the head
+	// only covered points in them, so they go too. they'd be confused with any
+	// block that's put in the same space later.
+	var tombstones []tombstone
+	for _, d := range s.tombstones {
+		dropped := false
+		for _, b := range s.chain[:n] {
+			dropped = dropped || b.position == d.block
+		}
+
+		if !dropped {
+			tombstones = append(tombstones, d)
+		}
+	}
+
+	// the space isn't reused until the index no longer refers to the blocks,
+	// so it doesn't matter that they're released before the header is written
+	err := s.withRoot(func(root *dbRoot) error {
+		root.position = s.chain[n].position
+
+		if len(tombstones) != len(s.tombstones) {
+			var d []byte
+			if len(tombstones) > 0 {
+				d = encodeTombstones(tombstones)
+			}
+
+			root.setProperty(PROPERTY_TOMBSTONES, d)
+		}
+
+		for _, b := range s.chain[:n] {
+			s.db.release(b.position, b.size())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	s.chain = append([]*block(nil), s.chain[n:]...)
+	s.tombstones = tombstones
+
+	if err := s.db.writeAndSwapHeader(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// retention returns the limits on a stream. limits that can't be decoded are
+// ignored.
+func (db *Database) retention(id []byte) Retention {
+	if d := db.root(id).property(PROPERTY_RETENTION); d != nil {
+		if r, ok := decodeRetention(d); ok {
+			return r
+		}
+	}
+
+	return Retention{}
+}
+
+// retention is stored in the index as the maximum age in nanoseconds and then
+// the maximum number of points, both as uint64s.
+
+func encodeRetention(r Retention) []byte {
+	d := make([]byte, 16)
+
+	binary.BigEndian.PutUint64(d[0:8], uint64(r.MaxAge))
+	binary.BigEndian.PutUint64(d[8:16], r.MaxPoints)
+
+	return d
+}
+
+func decodeRetention(d []byte) (Retention, bool) {
+	if len(d) != 16 {
+		return Retention{}, false
+	}
+
+	r := Retention{
+		MaxAge:    time.Duration(binary.BigEndian.Uint64(d[0:8])),
+		MaxPoints: binary.BigEndian.Uint64(d[8:16]),
+	}
+
+	if r.MaxAge < 0 {
+		return Retention{}, false
+	}
+
+	return r, true
+}
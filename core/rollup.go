@@ -0,0 +1,414 @@
+package jikan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// A Rollup keeps another stream, in the same database, up to date with
+// aggregates of a stream over each Step of time. The derived stream has a
+// float field for each of the aggregations, and a point at the start of every
+// step that had points in it. It's an ordinary stream, so it can be read,
+// aggregated and even rolled up again like any other.
+//
+// Steps are only rolled up once they're over, which is once there's a point at
+// or after their end.
+type Rollup struct {
+	// Stream is the name of the derived stream. If it's empty, it's the name of
+	// the source stream, an @ and the step, like "cpu@1h".
+	Stream []byte
+
+	Step         time.Duration
+	Aggregations []Aggregation
+}
+
+var (
+	ERR_BAD_ROLLUP = errors.New("rollups need a positive step and between 1 and 32 aggregations with different names, and can't roll a stream up into itself or into one that's already rolled up into")
+)
+
+// name returns the name of the derived stream for a rollup of the given
+// stream.
+func (r Rollup) name(source []byte) []byte {
+	if len(r.Stream) > 0 {
+		return r.Stream
+	}
+
+	// durations always have minutes and seconds, even when they're zero
+	step := r.Step.String()
+	if strings.HasSuffix(step, "m0s") {
+		step = strings.TrimSuffix(step, "0s")
+	}
+	if strings.HasSuffix(step, "h0m") {
+		step = strings.TrimSuffix(step, "0m")
+	}
+
+	return append(append(append([]byte(nil), source...), '@'), step...)
+}
+
+// fields returns the fields of the derived stream. they're named after the
+// aggregations, and after the source fields too if there's more than one.
+func (r Rollup) fields(source []Field) []Field {
+	fields := make([]Field, len(r.Aggregations))
+
+	for i, a := range r.Aggregations {
+		name := a.String()
+		if len(source) > 1 {
+			name = source[a.Field].Name + "_" + name
+		}
+
+		fields[i] = Field{Name: name, Type: TYPE_FLOAT64}
+	}
+
+	return fields
+}
+
+// options returns the options of the stream that a rollup of s is kept in.
+func (r Rollup) options(s *Stream) StreamOptions {
+	return StreamOptions{Precision: s.chain[0].precision, Fields: r.fields(s.Fields())}
+}
+
+func (r Rollup) valid(source []byte, fields []Field) bool {
+	if r.Step <= 0 || len(r.Aggregations) == 0 || len(r.Aggregations) > MAXIMUM_FIELDS {
+		return false
+	}
+
+	if name := r.name(source); bytes.Equal(name, source) || len(name) > 0xffff {
+		return false
+	}
+
+	for _, a := range r.Aggregations {
+		if !a.valid(len(fields)) {
+			return false
+		}
+	}
+
+	return validFields(r.fields(fields))
+}
+
+// Rollups returns the rollups that are kept from the stream.
+func (s *Stream) Rollups() []Rollup {
+	s.db.RLock()
+	defer s.db.RUnlock()
+
+	return s.db.rollups(s.id)
+}
+
+// AddRollup starts keeping a derived stream up to date with aggregates of this
+// one, creating the derived stream if it doesn't exist. Any steps that are
+// already over are rolled up straight away; after that, it's done whenever a
+// transaction on this stream is committed.
+func (s *Stream) AddRollup(r Rollup) error {
+	log.Debugf("adding rollup of `%s' by %s\n", s.id, r.Step)
+
+	if !r.valid(s.id, s.Fields()) {
+		return ERR_BAD_ROLLUP
+	}
+
+	r.Stream = r.name(s.id)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.db.checkRollup(s.id, r); err != nil {
+		return err
+	}
+
+	// the derived stream is made first, so that a rollup is never kept into a
+	// stream that's got the wrong fields
+	if _, err := s.db.StreamWithOptions(r.Stream, r.options(s)); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	err := s.withRoot(func(root *dbRoot) error {
+		rollups := s.db.rollups(s.id)
+
+		root.setProperty(PROPERTY_ROLLUPS, encodeRollups(append(rollups, r)))
+
+		return nil
+	})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if err := s.db.writeAndSwapHeader(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if err := s.rollup(r); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// checkRollup makes sure that a rollup can be added to a stream.
+func (db *Database) checkRollup(id []byte, r Rollup) error {
+	db.RLock()
+	defer db.RUnlock()
+
+	// the count is kept in a byte
+	if len(db.rollups(id)) >= 0xff {
+		return ERR_BAD_ROLLUP
+	}
+
+	// a derived stream can only be kept from one source, or the points from
+	// each would have to be interleaved, and could arrive out of order
+	for _, o := range db.roots {
+		for _, x := range db.rollups(o.id) {
+			if bytes.Equal(x.Stream, r.Stream) {
+				return ERR_BAD_ROLLUP
+			}
+		}
+	}
+
+	// the derived stream's transactions update its own rollups, so if they led
+	// back here, a commit would wait on itself
+	if db.rollsUpInto(r.Stream, id) {
+		return ERR_BAD_ROLLUP
+	}
+
+	return nil
+}
+
+// RemoveRollup stops keeping the named derived stream up to date. The derived
+// stream itself is left as it is.
+func (s *Stream) RemoveRollup(name []byte) error {
+	log.Debugf("removing rollup `%s' of `%s'\n", name, s.id)
+
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.withRoot(func(root *dbRoot) error {
+		var rollups []Rollup
+
+		for _, r := range s.db.rollups(s.id) {
+			if !bytes.Equal(r.Stream, name) {
+				rollups = append(rollups, r)
+			}
+		}
+
+		var d []byte
+		if len(rollups) > 0 {
+			d = encodeRollups(rollups)
+		}
+
+		root.setProperty(PROPERTY_ROLLUPS, d)
+
+		return nil
+	})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if err := s.db.writeAndSwapHeader(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// updateRollups brings every rollup of the stream up to date. the stream has
+// to be locked, so that it doesn't change underneath them.
+func (s *Stream) updateRollups() error {
+	s.db.RLock()
+	rollups := s.db.rollups(s.id)
+	s.db.RUnlock()
+
+	for _, r := range rollups {
+		if err := s.rollup(r); err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// rollup adds a point to the derived stream for every step that's over and
+// hasn't been rolled up yet. steps are aligned to the zero time, so hours and
+// days start on the hour and at midnight UTC.
+func (s *Stream) rollup(r Rollup) error {
+	if s.head.count == 0 {
+		return nil
+	}
+
+	d, err := s.db.StreamWithOptions(r.Stream, r.options(s))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	first := s.chain[0].startTime
+	if len(s.late) > 0 && s.late[0].t.Before(first) {
+		first = s.late[0].t
+	}
+
+	from := first.Truncate(r.Step)
+	if d.head.count > 0 {
+		from = d.head.time.Add(r.Step)
+	}
+
+	to := s.head.time.Truncate(r.Step)
+
+	if !from.Before(to) {
+		return nil
+	}
+
+	log.Debugf("rolling up `%s' into `%s' from %s to %s\n", s.id, r.Stream, from, to)
+
+	// every aggregation finds the same buckets, since empty ones are left out
+	var buckets []Bucket
+	var values [][]interface{}
+
+	for i, a := range r.Aggregations {
+		if buckets, err = s.Aggregate(from, to, r.Step, a); err != nil {
+			return stackerr.Wrap(err)
+		}
+
+		if i == 0 {
+			values = make([][]interface{}, len(buckets))
+		}
+
+		for k, b := range buckets {
+			values[k] = append(values[k], b.Value)
+		}
+	}
+
+	return d.WithTx(func(tx *StreamTx) error {
+		for k, b := range buckets {
+			if err := tx.AddRow(b.Start, values[k]...); err != nil {
+				return stackerr.Wrap(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// rollups returns the rollups kept from a stream. rollups that can't be
+// decoded are ignored.
+func (db *Database) rollups(id []byte) []Rollup {
+	if d := db.root(id).property(PROPERTY_ROLLUPS); d != nil {
+		if rollups, ok := decodeRollups(d); ok {
+			return rollups
+		}
+	}
+
+	return nil
+}
+
+// rollsUpInto reports whether the stream id is rolled up into target, directly
+// or through the rollups of other streams.
+func (db *Database) rollsUpInto(id, target []byte) bool {
+	seen := make(map[string]bool)
+
+	var walk func(id []byte) bool
+	walk = func(id []byte) bool {
+		if bytes.Equal(id, target) {
+			return true
+		}
+
+		if seen[string(id)] || db.root(id) == nil {
+			return false
+		}
+
+		seen[string(id)] = true
+
+		for _, r := range db.rollups(id) {
+			if walk(r.Stream) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return walk(id)
+}
+
+// rollups are stored in the index as a count, and then for each one:
+//
+//   0   length of the derived stream's name (uint16)
+//   2   name
+//   ... step in nanoseconds (uint64)
+//   ... aggregation count
+//   ... function, field and percentile (as the bits of a float) of each
+//       aggregation, 10 bytes each
+
+func encodeRollups(rollups []Rollup) []byte {
+	d := []byte{byte(len(rollups))}
+
+	for _, r := range rollups {
+		var buf [8]byte
+
+		binary.BigEndian.PutUint16(buf[0:2], uint16(len(r.Stream)))
+		d = append(d, buf[0:2]...)
+		d = append(d, r.Stream...)
+
+		binary.BigEndian.PutUint64(buf[:], uint64(r.Step))
+		d = append(d, buf[:]...)
+		d = append(d, byte(len(r.Aggregations)))
+
+		for _, a := range r.Aggregations {
+			binary.BigEndian.PutUint64(buf[:], math.Float64bits(a.Percentile))
+
+			d = append(d, byte(a.Func), byte(a.Field))
+			d = append(d, buf[:]...)
+		}
+	}
+
+	return d
+}
+
+func decodeRollups(d []byte) ([]Rollup, bool) {
+	if len(d) < 1 {
+		return nil, false
+	}
+
+	rollups := make([]Rollup, int(d[0]))
+
+	o := 1
+	for i := range rollups {
+		if o+2 > len(d) {
+			return nil, false
+		}
+
+		n := int(binary.BigEndian.Uint16(d[o : o+2]))
+		if o+2+n+9 > len(d) {
+			return nil, false
+		}
+
+		r := &rollups[i]
+
+		r.Stream = append([]byte(nil), d[o+2:o+2+n]...)
+		r.Step = time.Duration(binary.BigEndian.Uint64(d[o+2+n : o+10+n]))
+		r.Aggregations = make([]Aggregation, int(d[o+10+n]))
+
+		o += 11 + n
+
+		for k := range r.Aggregations {
+			if o+10 > len(d) {
+				return nil, false
+			}
+
+			r.Aggregations[k] = Aggregation{
+				Func:       AggregateFunc(d[o]),
+				Field:      int(d[o+1]),
+				Percentile: math.Float64frombits(binary.BigEndian.Uint64(d[o+2 : o+10])),
+			}
+
+			o += 10
+		}
+	}
+
+	if o != len(d) {
+		return nil, false
+	}
+
+	return rollups, true
+}
@@ -0,0 +1,260 @@
+package jikan
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// MatchType is the way that a Matcher compares a label's value.
+type MatchType uint8
+
+const (
+	MATCH_EQUAL  MatchType = 0
+	MATCH_REGEXP MatchType = 1
+)
+
+var (
+	ERR_BAD_MATCHER = errors.New("matchers must be given as name=value or name=~regexp, separated by commas")
+)
+
+// A Matcher picks out streams by one of their labels. A stream only matches if
+// it has the label, and its value is equal to Value or, for MATCH_REGEXP,
+// matches the whole of the regular expression in Value.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher makes a matcher, compiling its regular expression if it has one.
+func NewMatcher(typ MatchType, name, value string) (*Matcher, error) {
+	m := Matcher{Type: typ, Name: name, Value: value}
+
+	switch typ {
+	case MATCH_EQUAL:
+	case MATCH_REGEXP:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+
+		m.re = re
+	default:
+		return nil, ERR_BAD_MATCHER
+	}
+
+	if name == "" {
+		return nil, ERR_BAD_MATCHER
+	}
+
+	return &m, nil
+}
+
+// ParseMatchers turns a list of matchers like "region=eu,host=~web.*" into
+// Matchers. Regular expressions can't contain commas.
+func ParseMatchers(s string) ([]*Matcher, error) {
+	var matchers []*Matcher
+
+	if s == "" {
+		return matchers, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, ERR_BAD_MATCHER
+		}
+
+		typ := MATCH_EQUAL
+		if strings.HasPrefix(kv[1], "~") {
+			typ, kv[1] = MATCH_REGEXP, kv[1][1:]
+		}
+
+		m, err := NewMatcher(typ, kv[0], kv[1])
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+
+		matchers = append(matchers, m)
+	}
+
+	return matchers, nil
+}
+
+// Matches reports whether a label value is matched.
+func (m *Matcher) Matches(v string) bool {
+	if m.Type == MATCH_REGEXP {
+		return m.re.MatchString(v)
+	}
+
+	return v == m.Value
+}
+
+// Select returns every stream with labels that satisfy all of the matchers, in
+// the order that they were created. It's answered from an index of the labels
+// that's kept in the file, so only the streams that match are loaded.
+func (db *Database) Select(matchers ...*Matcher) ([]*Stream, error) {
+	log.Debugf("selecting streams with %d matchers\n", len(matchers))
+
+	ids := db.selectRoots(matchers)
+
+	streams := make([]*Stream, len(ids))
+
+	for i, id := range ids {
+		s, err := db.Stream(id)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+
+		streams[i] = s
+	}
+
+	return streams, nil
+}
+
+// selectRoots returns the names of the streams that satisfy all of the
+// matchers, in index order.
+func (db *Database) selectRoots(matchers []*Matcher) [][]byte {
+	db.RLock()
+	defer db.RUnlock()
+
+	var found map[*dbRoot]bool
+
+	if len(matchers) == 0 {
+		found = make(map[*dbRoot]bool)
+
+		for _, r := range db.roots {
+			found[r] = true
+		}
+	}
+
+	for i, m := range matchers {
+		matched := make(map[*dbRoot]bool)
+
+		for value, roots := range db.labels[m.Name] {
+			if !m.Matches(value) {
+				continue
+			}
+
+			for _, r := range roots {
+				if i == 0 || found[r] {
+					matched[r] = true
+				}
+			}
+		}
+
+		found = matched
+	}
+
+	var ids [][]byte
+
+	for _, r := range db.roots {
+		if found[r] {
+			ids = append(ids, r.id)
+		}
+	}
+
+	return ids
+}
+
+// dbLabels is the inverted index of stream labels: for each label name and
+// value, the streams that have it.
+type dbLabels map[string]map[string][]*dbRoot
+
+// add indexes the labels of a stream.
+func (l dbLabels) add(r *dbRoot) {
+	for name, value := range rootLabels(r) {
+		if l[name] == nil {
+			l[name] = make(map[string][]*dbRoot)
+		}
+
+		l[name][value] = append(l[name][value], r)
+	}
+}
+
+// remove takes a stream out of the index.
+func (l dbLabels) remove(r *dbRoot) {
+	for name, value := range rootLabels(r) {
+		roots := l[name][value]
+
+		for i, o := range roots {
+			if o == r {
+				roots = append(roots[:i:i], roots[i+1:]...)
+				break
+			}
+		}
+
+		if len(roots) > 0 {
+			l[name][value] = roots
+		} else {
+			delete(l[name], value)
+		}
+
+		if len(l[name]) == 0 {
+			delete(l, name)
+		}
+	}
+}
+
+// equal reports whether two indexes hold the same streams for the same labels.
+func (l dbLabels) equal(o dbLabels) bool {
+	if len(l) != len(o) {
+		return false
+	}
+
+	for name, values := range l {
+		if len(values) != len(o[name]) {
+			return false
+		}
+
+		for value, roots := range values {
+			other := o[name][value]
+
+			if len(roots) != len(other) {
+				return false
+			}
+
+			seen := make(map[*dbRoot]bool)
+			for _, r := range roots {
+				seen[r] = true
+			}
+
+			for _, r := range other {
+				if !seen[r] {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// rootLabels returns the labels in a stream's metadata. streams with metadata
+// that can't be decoded aren't indexed.
+func rootLabels(r *dbRoot) map[string]string {
+	if d := r.property(PROPERTY_METADATA); d != nil {
+		if m, ok := decodeMetadata(d); ok {
+			return m.Labels
+		}
+	}
+
+	return nil
+}
+
+// buildLabels indexes the labels of all the given streams.
+func buildLabels(roots []*dbRoot) dbLabels {
+	l := make(dbLabels)
+
+	for _, r := range roots {
+		l.add(r)
+	}
+
+	return l
+}
@@ -8,6 +8,47 @@ import (
 	"github.com/facebookgo/stackerr"
 )
 
+// StreamOptions are the settings that a stream is created with. They can't be
+// changed once it exists.
+//
+// Fields declares the values in each point, for a stream that has more than
+// one. If it's empty, each point has a single value of type Type, named
+// DEFAULT_FIELD; otherwise, Type is ignored.
+type StreamOptions struct {
+	Precision Precision
+	Type      ValueType
+	Codec     CodecID
+	Fields    []Field
+}
+
+// fields returns the fields that a stream created with the options would have.
+func (o StreamOptions) fields() []Field {
+	if len(o.Fields) == 0 {
+		return []Field{{Name: DEFAULT_FIELD, Type: o.Type}}
+	}
+
+	return o.Fields
+}
+
+// equal reports whether two sets of options would make the same stream.
+func (o StreamOptions) equal(p StreamOptions) bool {
+	return o.Precision == p.Precision && o.Codec == p.Codec && equalFields(o.fields(), p.fields())
+}
+
+// properties returns the properties to keep in the index for a stream created
+// with the options.
+func (o StreamOptions) properties() []dbProperty {
+	if len(o.Fields) == 0 {
+		return nil
+	}
+
+	return []dbProperty{{tag: PROPERTY_SCHEMA, data: encodeSchema(o.Fields)}}
+}
+
+// MAXIMUM_BLOCK_LENGTH is the largest data area that a stream grows a new block
+// to. Compacted streams can have bigger blocks than this.
+const MAXIMUM_BLOCK_LENGTH = 1 << 20
+
 type Stream struct {
 	sync.Mutex
 
@@ -15,12 +56,41 @@ type Stream struct {
 	db    *Database
 	head  *block
 	chain []*block
+
+	// fields is nil unless the stream was created with them
+	fields []Field
+
+	// late holds points that were added out of order, if the stream takes them
+	outOfOrder bool
+	late       []latePoint
+
+	duplicates DuplicatePolicy
+
+	// tombstones hold the points that have been deleted or updated, until the
+	// database is compacted. like late, the list is never changed in place.
+	tombstones []tombstone
 }
 
-func newStream(db *Database, id []byte) (*Stream, error) {
+func newStream(db *Database, id []byte, options StreamOptions) (*Stream, error) {
 	log.Debugf("creating stream `%s'\n", id)
 
-	head, err := db.getRoot(id)
+	if !options.Precision.valid() {
+		return nil, ERR_BAD_PRECISION
+	}
+
+	if len(options.Fields) == 0 && !options.Type.valid() {
+		return nil, ERR_BAD_VALUE_TYPE
+	}
+
+	if len(options.Fields) > 0 && !validFields(options.Fields) {
+		return nil, ERR_BAD_FIELDS
+	}
+
+	if !options.Codec.valid() {
+		return nil, ERR_BAD_CODEC
+	}
+
+	head, err := db.getRoot(id, options)
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
@@ -48,13 +118,57 @@ func newStream(db *Database, id []byte) (*Stream, error) {
 		chain: chain,
 	}
 
+	if d := db.root(id).property(PROPERTY_SCHEMA); d != nil {
+		fields, ok := decodeSchema(d)
+		if !ok || !equalTypes(fieldTypes(fields), chain[0].types) {
+			return nil, &CorruptionError{Position: chain[0].position, What: "stream schema"}
+		}
+
+		s.fields = fields
+	}
+
+	if d := db.root(id).property(PROPERTY_LATE); d != nil {
+		enabled, late, ok := decodeLate(d, len(chain[0].types))
+		if !ok {
+			return nil, &CorruptionError{Position: chain[0].position, What: "stream late points"}
+		}
+
+		s.outOfOrder = enabled
+		s.late = late
+	}
+
+	if d := db.root(id).property(PROPERTY_DUPLICATES); d != nil {
+		p, ok := decodeDuplicates(d)
+		if !ok {
+			return nil, &CorruptionError{Position: chain[0].position, What: "stream duplicate policy"}
+		}
+
+		s.duplicates = p
+	}
+
+	if d := db.root(id).property(PROPERTY_TOMBSTONES); d != nil {
+		tombstones, ok := decodeTombstones(d, len(chain[0].types))
+		if !ok {
+			return nil, &CorruptionError{Position: chain[0].position, What: "stream tombstones"}
+		}
+
+		s.tombstones = tombstones
+	}
+
 	return &s, nil
 }
 
 func (s *Stream) Tx() *StreamTx {
 	s.Lock()
 
-	return &StreamTx{s}
+	return &StreamTx{
+		s:     s,
+		head:  s.head.blockState,
+		chain: len(s.chain),
+		late:  s.late,
+
+		tombstones: s.tombstones,
+	}
 }
 
 func (s *Stream) WithTx(fn func(t *StreamTx) error) error {
@@ -75,33 +189,213 @@ func (s *Stream) WithTx(fn func(t *StreamTx) error) error {
 	}
 }
 
+// Name returns the name of the stream.
+func (s *Stream) Name() []byte {
+	return s.id
+}
+
+// Options returns the options that the stream was created with.
+func (s *Stream) Options() StreamOptions {
+	o := StreamOptions{
+		Precision: s.chain[0].precision,
+		Type:      s.chain[0].types[0],
+		Codec:     s.chain[0].codecID,
+	}
+
+	// a stream that's been repaired may have lost the names of its fields
+	if s.fields != nil {
+		o.Fields = append([]Field(nil), s.fields...)
+	} else if len(s.chain[0].types) > 1 {
+		o.Fields = fieldsFromTypes(s.chain[0].types)
+	}
+
+	return o
+}
+
+// Fields returns the fields of each point in the stream. There's always at
+// least one.
+func (s *Stream) Fields() []Field {
+	return s.Options().fields()
+}
+
+// withRoot calls fn with the stream's entry in the index, with the database
+// locked. the entry is gone once the stream has been deleted, in which case it
+// returns ERR_STREAM_NOT_FOUND.
+func (s *Stream) withRoot(fn func(root *dbRoot) error) error {
+	return s.db.withLock(func() error {
+		root := s.db.root(s.id)
+		if root == nil {
+			return ERR_STREAM_NOT_FOUND
+		}
+
+		return fn(root)
+	})
+}
+
+// Metadata returns the stream's labels, unit and description.
+func (s *Stream) Metadata() Metadata {
+	s.db.RLock()
+	defer s.db.RUnlock()
+
+	if d := s.db.root(s.id).property(PROPERTY_METADATA); d != nil {
+		if m, ok := decodeMetadata(d); ok {
+			return m
+		}
+	}
+
+	return Metadata{Labels: make(map[string]string)}
+}
+
+// SetMetadata replaces the stream's labels, unit and description. They're
+// kept in the index, so this writes the database header.
+func (s *Stream) SetMetadata(m Metadata) error {
+	if !m.valid() {
+		return ERR_BAD_METADATA
+	}
+
+	var d []byte
+	if !m.empty() {
+		d = encodeMetadata(m)
+	}
+
+	err := s.withRoot(func(root *dbRoot) error {
+		s.db.labels.remove(root)
+		root.setProperty(PROPERTY_METADATA, d)
+		s.db.labels.add(root)
+
+		return nil
+	})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if err := s.db.writeAndSwapHeader(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// Count returns the number of points in the stream. Points that have been
+// deleted or updated are counted until the database is compacted.
+func (s *Stream) Count() uint64 {
+	n := uint64(len(s.late))
+
+	for _, b := range s.chain {
+		n += uint64(b.count)
+	}
+
+	return n
+}
+
+// Range returns the times of the first and last points in the stream. If the
+// stream is empty, both are zero.
+func (s *Stream) Range() (time.Time, time.Time, error) {
+	var first, last time.Time
+
+	for _, b := range s.chain {
+		if b.count == 0 {
+			break
+		}
+
+		if first.IsZero() {
+			first = b.startTime
+		}
+
+		last = b.startTime
+	}
+
+	// late points can be before the first block, but not after the last
+	if late := s.late; len(late) > 0 && (first.IsZero() || late[0].t.Before(first)) {
+		first = late[0].t
+	}
+
+	if first.IsZero() {
+		return first, last, nil
+	}
+
+	// the first and last points might have been deleted, so the whole stream
+	// has to be read
+	if len(s.tombstones) > 0 {
+		first, last = time.Time{}, time.Time{}
+
+		for it := s.Iterator(); it.Good(); it.Next() {
+			if first.IsZero() {
+				first = it.Time
+			}
+
+			last = it.Time
+		}
+
+		return first, last, nil
+	}
+
+	// only the first point of each block is kept in its header, so the last
+	// point has to be found by decoding the last block with data in it
+	it := s.Iterator()
+
+	if err := it.Seek(last); err != nil {
+		return first, last, stackerr.Wrap(err)
+	}
+
+	for ; it.Good(); it.Next() {
+		last = it.Time
+	}
+
+	return first, last, nil
+}
+
 func (s *Stream) Iterator() *StreamIterator {
 	return newStreamIterator(s)
 }
 
-func (s *Stream) add(t time.Time, v int64) error {
-	if err := s.head.add(t, v); err == nil {
+func (s *Stream) add(t time.Time, vs []int64) error {
+	unit := s.head.precision.Duration()
+	late := s.head.count > 0 && t.Truncate(unit).Before(s.head.time)
+
+	// points that are late, without somewhere to put them, are refused anyway
+	if (s.duplicates == DUPLICATES_KEEP_FIRST || s.duplicates == DUPLICATES_ERROR) && (!late || s.outOfOrder) {
+		if duplicate, err := s.duplicate(t.Truncate(unit)); err != nil {
+			return stackerr.Wrap(err)
+		} else if duplicate && s.duplicates == DUPLICATES_KEEP_FIRST {
+			return nil
+		} else if duplicate {
+			return ERR_DUPLICATE_TIME
+		}
+	}
+
+	if late && s.outOfOrder {
+		return s.addLate(t, vs)
+	}
+
+	if err := s.head.add(t, vs); err == nil {
 		return nil
 	} else if err != ERR_BLOCK_FULL {
 		return stackerr.Wrap(err)
 	}
 
 	// if we get here, it means we ran out of space. time to allocate some more!
+	// the new block is only linked in memory for now - the header of the old
+	// head block gets written when the transaction is committed.
 
-	next, err := s.db.newBlock(s.head.length * 2)
-	if err != nil {
-		return stackerr.Wrap(err)
+	// each block is twice the size of the last, so there aren't too many of
+	// them, but only up to a point, so that retention can drop old data in
+	// pieces that aren't too big
+	size := s.head.length * 2
+	if size > MAXIMUM_BLOCK_LENGTH {
+		size = MAXIMUM_BLOCK_LENGTH
 	}
 
-	s.head.next = next.position
-	if err := s.head.writeAndSwapHeader(); err != nil {
+	next, err := s.db.newBlock(size, s.Options())
+	if err != nil {
 		return stackerr.Wrap(err)
 	}
 
+	s.head.next = next.position
 	s.head = next
 	s.chain = append(s.chain, s.head)
 
-	if err := s.head.add(t, v); err != nil {
+	if err := s.head.add(t, vs); err != nil {
 		return stackerr.Wrap(err)
 	}
 
@@ -1,91 +1,348 @@
 package jikan
 
 import (
-	"encoding/binary"
+	"sort"
 	"time"
 
 	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
 )
 
 type StreamIterator struct {
 	str *Stream
 	idx int
-	pos int
+	rd  *blockReader
 
 	good bool
 
+	// remaining repeats of the current run-length encoded record
+	run     uint32
+	tdelta  int64
+	vdeltas []int64
+
+	// bt and braws are the time and values of the last point decoded from the
+	// blocks, which the next record is relative to. buffered is set while that
+	// point is waiting for the late points before it to be returned.
+	bt       time.Time
+	braws    []int64
+	buffered bool
+
+	// late points haven't been merged into the blocks yet, so they're returned
+	// in between the points in them. the stream's list is never changed in
+	// place, so the iterator keeps hold of the one that it started with.
+	late []latePoint
+	li   int
+
+	// keepLast is set for streams that only keep the last of the points at the
+	// same time
+	keepLast bool
+
+	// points in the blocks that have been deleted are skipped. bn counts the
+	// points decoded from the current block, and marks holds the index in the
+	// chain of the block that each tombstone was made at.
+	tombstones []tombstone
+	marks      []int
+	bn         uint32
+
 	from time.Time
 	to   time.Time
 
-	Time  time.Time
-	Value int64
+	// raws holds the current value of each field as it's stored: an integer,
+	// or the bits of a float
+	raws  []int64
+	types []ValueType
+
+	// Value and FloatValue both hold the current value of the first field. for
+	// floats, Value is truncated; for integers, FloatValue is just converted.
+	// the other fields are read with Field and FloatField.
+	Time       time.Time
+	Value      int64
+	FloatValue float64
 }
 
 func newStreamIterator(s *Stream) *StreamIterator {
 	log.Debugf("constructing new iterator\n")
 
+	types := s.chain[0].types
+
 	i := StreamIterator{
-		str:  s,
-		good: true,
+		str:     s,
+		good:    true,
+		vdeltas: make([]int64, len(types)),
+		braws:   make([]int64, len(types)),
+		raws:    make([]int64, len(types)),
+		types:   types,
+		late:    mergeLate(replacements(s.tombstones), s.late),
+
+		keepLast: s.duplicates == DUPLICATES_KEEP_LAST,
+
+		tombstones: s.tombstones,
+	}
+
+	positions := make([]uint64, len(s.chain))
+	for n, b := range s.chain {
+		positions[n] = b.position
 	}
 
+	i.marks = markTombstones(s.tombstones, positions)
+
 	i.Next()
 
 	return &i
 }
 
 func (i *StreamIterator) Next() error {
-START:
-	if i.idx >= len(i.str.chain) {
+	return i.advance(time.Time{})
+}
+
+// advance moves to the next point that's at or after both t and the lower
+// bound of the iterator, stopping if it passes the upper bound.
+func (i *StreamIterator) advance(t time.Time) error {
+	for {
+		if err := i.next(); err != nil {
+			return stackerr.Wrap(err)
+		}
+
+		if !i.good {
+			return nil
+		}
+
+		if i.Time.Before(t) || (!i.from.IsZero() && i.Time.Before(i.from)) {
+			continue
+		}
+
+		if !i.to.IsZero() && i.Time.After(i.to) {
+			i.stop()
+		}
+
+		return nil
+	}
+}
+
+// Seek moves the iterator to the first point at or after t. The starting time
+// of each block is kept in its header, so this only has to decode the points
+// in the block that t falls in.
+func (i *StreamIterator) Seek(t time.Time) error {
+	chain := i.str.chain
+
+	// empty blocks can only be found at the end of the chain. points at the
+	// same time can span several blocks, so this finds the first block that
+	// starts at or after t, and the one before it is the first that can hold a
+	// point at t.
+	n := sort.Search(len(chain), func(k int) bool {
+		return chain[k].count == 0 || !chain[k].startTime.Before(t)
+	})
+
+	if n > 0 {
+		n--
+	}
+
+	log.Debugf("seeking to %s, starting at block %d\n", t, n)
+
+	i.idx = n
+	i.rd = nil
+	i.run = 0
+	i.good = true
+
+	i.bt = time.Time{}
+	i.bn = 0
+	i.buffered = false
+	i.reset()
+
+	i.li = sort.Search(len(i.late), func(k int) bool {
+		return !i.late[k].t.Before(t)
+	})
+
+	if err := i.advance(t); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// next moves to the next point. in streams that keep the last of the points
+// at the same time, the earlier ones are skipped, which means looking ahead.
+func (i *StreamIterator) next() error {
+	for {
+		if err := i.pick(); err != nil {
+			return stackerr.Wrap(err)
+		}
+
+		if !i.good || !i.keepLast {
+			return nil
+		}
+
+		if !i.buffered {
+			if err := i.nextBlock(); err != nil {
+				i.good = false
+
+				return stackerr.Wrap(err)
+			}
+		}
+
+		if !(i.buffered && i.bt.Equal(i.Time)) && !(i.li < len(i.late) && i.late[i.li].t.Equal(i.Time)) {
+			return nil
+		}
+	}
+}
+
+// pick moves to the next point, whether it's from the blocks or the late
+// points. points from the blocks go first when they're at the same time.
+func (i *StreamIterator) pick() error {
+	if !i.buffered {
+		if err := i.nextBlock(); err != nil {
+			i.good = false
+
+			return stackerr.Wrap(err)
+		}
+	}
+
+	if i.li < len(i.late) && (!i.buffered || i.late[i.li].t.Before(i.bt)) {
+		i.Time = i.late[i.li].t
+		copy(i.raws, i.late[i.li].vs)
+		i.li++
+	} else if i.buffered {
+		i.Time = i.bt
+		copy(i.raws, i.braws)
+		i.buffered = false
+	} else {
 		i.good = false
 
 		return nil
 	}
 
+	i.Value = i.Field(0)
+	i.FloatValue = i.FloatField(0)
+
+	i.good = true
+
+	return nil
+}
+
+// nextBlock decodes the next point from the blocks, if there is one.
+func (i *StreamIterator) nextBlock() error {
+START:
+	if i.idx >= len(i.str.chain) {
+		return nil
+	}
+
 	blk := i.str.chain[i.idx]
 
+	if i.rd == nil {
+		i.rd = blk.reader()
+	}
+
 	log.Debugf("moving to next item\n")
-	log.Debugf("idx %d, pos %d/%d/%d, good %#v\n", i.idx, i.pos, blk.used, blk.length, i.good)
+	log.Debugf("idx %d, pos %d/%d/%d, good %#v\n", i.idx, i.rd.d.Offset(), blk.used, blk.length, i.good)
 
-	if uint32(i.pos) == blk.used {
+	if i.run == 0 && !i.rd.more() {
 		i.idx++
-		i.pos = 0
+		i.rd = nil
 
-		i.Time = time.Time{}
-		i.Value = 0
+		i.bt = time.Time{}
+		i.bn = 0
+		i.reset()
 
 		// can't just fall through here, in case the next block has been allocated
 		// but is also empty. weird edge case, but it's possible...
 		goto START
 	}
 
-	tdelta, n := binary.Varint(blk.db.mm[blk.position+93+uint64(i.pos) : blk.position+93+uint64(blk.used)])
-	i.pos += n
-	vdelta, n := binary.Varint(blk.db.mm[blk.position+93+uint64(i.pos) : blk.position+93+uint64(blk.used)])
-	i.pos += n
+	if i.run == 0 {
+		count, tdelta, err := i.rd.next(i.vdeltas)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+
+		i.run = count
+		i.tdelta = tdelta
+	}
+
+	i.run--
 
-	if i.Time.IsZero() {
-		i.Time = time.Unix(tdelta/int64(time.Millisecond), tdelta%int64(time.Millisecond))
+	// times are stored in units of the block's precision, and the first record
+	// in each block is relative to the unix epoch
+	if i.bt.IsZero() {
+		i.bt = time.Unix(0, 0).Add(time.Duration(i.tdelta) * blk.precision.Duration())
 	} else {
-		i.Time = i.Time.Add(time.Duration(tdelta))
+		i.bt = i.bt.Add(time.Duration(i.tdelta) * blk.precision.Duration())
 	}
 
-	i.Value = i.Value + vdelta
+	for k, typ := range i.types {
+		i.braws[k] = typ.apply(i.braws[k], i.vdeltas[k])
+	}
 
-	i.good = true
+	i.bn++
+
+	// deleted points still have to be decoded, since the next point is
+	// relative to them, but they're never returned
+	if i.deleted() {
+		goto START
+	}
+
+	i.buffered = true
 
 	return nil
 }
 
+// deleted reports whether the last point decoded from the blocks has been
+// deleted.
+func (i *StreamIterator) deleted() bool {
+	return buried(i.tombstones, i.marks, i.idx, i.bn, i.bt)
+}
+
+// reset puts the values back to zero, which the first point in each block is
+// relative to.
+func (i *StreamIterator) reset() {
+	for k := range i.braws {
+		i.braws[k] = 0
+	}
+}
+
+// Field returns the current value of the nth field as an integer, truncating
+// floats.
+func (i *StreamIterator) Field(n int) int64 {
+	return i.types[n].integer(i.raws[n])
+}
+
+// FloatField returns the current value of the nth field as a float.
+func (i *StreamIterator) FloatField(n int) float64 {
+	return i.types[n].float(i.raws[n])
+}
+
+// stop ends iteration, leaving the iterator positioned past the last block.
+func (i *StreamIterator) stop() {
+	i.good = false
+	i.idx = len(i.str.chain)
+	i.rd = nil
+	i.run = 0
+	i.buffered = false
+	i.li = len(i.late)
+}
+
+// From skips any points before t. It can be called at any time, and if the
+// iterator's current point is before t, the iterator is advanced.
 func (i *StreamIterator) From(t time.Time) *StreamIterator {
 	i.from = t
 
+	// a failed seek leaves the iterator stopped
+	if i.good && i.Time.Before(t) {
+		if err := i.Seek(t); err != nil {
+			log.Critical(err)
+		}
+	}
+
 	return i
 }
 
+// To ends iteration after the last point that's not after t.
 func (i *StreamIterator) To(t time.Time) *StreamIterator {
 	i.to = t
 
+	if i.good && i.Time.After(t) {
+		i.stop()
+	}
+
 	return i
 }
 
@@ -1,6 +1,8 @@
 package jikan
 
 import (
+	"fmt"
+	"math"
 	"time"
 
 	"github.com/facebookgo/stackerr"
@@ -8,28 +10,207 @@ import (
 
 type StreamTx struct {
 	s *Stream
+
+	// state of the stream at the start of the transaction, used to roll back
+	// any changes if it's cancelled
+	head  blockState
+	chain int
+	late  []latePoint
+
+	// tombstones is the stream's list at the start, and buried is set once any
+	// points have been deleted or updated
+	tombstones []tombstone
+	buried     bool
 }
 
+// Add adds a point to an integer stream with a single field.
 func (s *StreamTx) Add(t time.Time, v int64) error {
-	if err := s.s.add(t, v); err != nil {
+	if len(s.s.head.types) != 1 {
+		return ERR_WRONG_FIELD_COUNT
+	}
+
+	if s.s.head.types[0] != TYPE_INT64 {
+		return ERR_WRONG_VALUE_TYPE
+	}
+
+	return s.add(t, []int64{v})
+}
+
+// AddFloat adds a point to a float stream with a single field.
+func (s *StreamTx) AddFloat(t time.Time, v float64) error {
+	if len(s.s.head.types) != 1 {
+		return ERR_WRONG_FIELD_COUNT
+	}
+
+	if s.s.head.types[0] != TYPE_FLOAT64 {
+		return ERR_WRONG_VALUE_TYPE
+	}
+
+	return s.add(t, []int64{int64(math.Float64bits(v))})
+}
+
+// AddRow adds a point with a value for each of the stream's fields, in order.
+// Integer fields take an int or int64, and float fields take a float64.
+func (s *StreamTx) AddRow(t time.Time, values ...interface{}) error {
+	vs, err := s.row(values)
+	if err != nil {
+		return err
+	}
+
+	return s.add(t, vs)
+}
+
+// row converts the values of a row to the way they're stored.
+func (s *StreamTx) row(values []interface{}) ([]int64, error) {
+	types := s.s.head.types
+
+	if len(values) != len(types) {
+		return nil, ERR_WRONG_FIELD_COUNT
+	}
+
+	vs := make([]int64, len(values))
+
+	for i, v := range values {
+		switch v := v.(type) {
+		case int:
+			if types[i] != TYPE_INT64 {
+				return nil, ERR_WRONG_VALUE_TYPE
+			}
+
+			vs[i] = int64(v)
+		case int64:
+			if types[i] != TYPE_INT64 {
+				return nil, ERR_WRONG_VALUE_TYPE
+			}
+
+			vs[i] = v
+		case float64:
+			if types[i] != TYPE_FLOAT64 {
+				return nil, ERR_WRONG_VALUE_TYPE
+			}
+
+			vs[i] = int64(math.Float64bits(v))
+		default:
+			return nil, ERR_WRONG_VALUE_TYPE
+		}
+	}
+
+	return vs, nil
+}
+
+// add adds a point with its values as they're stored, whatever the stream's
+// types.
+func (s *StreamTx) add(t time.Time, vs []int64) error {
+	if err := s.s.add(t, vs); err != nil {
 		return stackerr.Wrap(err)
 	} else {
 		return nil
 	}
 }
 
+// CommittedError is returned by Commit when the transaction was written, but
+// the stream's rollups or retention couldn't be applied afterwards. The points
+// are in the stream, so the transaction shouldn't be retried.
+type CommittedError struct {
+	Err error
+}
+
+func (e *CommittedError) Error() string {
+	return fmt.Sprintf("transaction was committed, but %s", e.Err)
+}
+
+// Commit writes the transaction to disk, and then brings the stream's rollups
+// up to date and applies its retention. If either of those fails, the points
+// have still been committed, and the error is a *CommittedError.
 func (s *StreamTx) Commit() error {
 	defer s.s.Unlock()
 
-	if err := s.s.head.writeAndSwapHeader(); err != nil {
+	if err := s.commit(); err != nil {
 		return stackerr.Wrap(err)
-	} else {
-		return nil
 	}
+
+	// rollups are only brought up to date once the points that they're made
+	// from have been written, while the stream is still locked
+	if err := s.s.updateRollups(); err != nil {
+		return &CommittedError{Err: err}
+	}
+
+	// and old blocks are only dropped once they've been rolled up
+	if err := s.s.retain(); err != nil {
+		return &CommittedError{Err: err}
+	}
+
+	return nil
+}
+
+// commit writes the transaction to disk, without doing anything else that a
+// commit sets off. the stream is left locked.
+func (s *StreamTx) commit() error {
+	// blocks chained during this transaction aren't reachable until the old
+	// head block's header is written, so they go first, then the database
+	// header (to persist the space they occupy), and then finally the old head.
+	if len(s.s.chain) > s.chain {
+		for i := len(s.s.chain) - 1; i >= s.chain; i-- {
+			if err := s.s.chain[i].writeAndSwapHeader(); err != nil {
+				return stackerr.Wrap(err)
+			}
+		}
+
+		if err := s.s.db.writeAndSwapHeader(); err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+
+	if err := s.s.chain[s.chain-1].writeAndSwapHeader(); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	// late points are only ever added during a transaction, so if there are
+	// more of them, some were added. deletions can drop them, but only along
+	// with a tombstone.
+	if len(s.s.late) != len(s.late) || s.buried {
+		if err := s.s.writeLate(); err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+
+	return nil
 }
 
 func (s *StreamTx) Cancel() error {
-	s.s.Unlock()
+	defer s.s.Unlock()
+
+	// nothing has been written to the headers on disk yet, so all we need to do
+	// is put the in-memory state back the way it was. the data written past the
+	// old end of the head block isn't visible to anyone, and blocks chained
+	// during this transaction were never referenced on disk, so their space can
+	// be reused straight away.
+	var free []*dbFree
+	for _, b := range s.s.chain[s.chain:] {
+		free = append(free, &dbFree{
+			position: b.position,
+			length:   b.size(),
+		})
+	}
+
+	// the free list is shared by every stream, so it can only be changed with
+	// the database locked
+	err := s.s.db.withLock(func() error {
+		s.s.db.free = mergeFree(s.s.db.free, free)
+
+		return nil
+	})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	head := s.s.chain[s.chain-1]
+	head.blockState = s.head
+
+	s.s.head = head
+	s.s.chain = s.s.chain[:s.chain]
+	s.s.late = s.late
+	s.s.tombstones = s.tombstones
 
 	return nil
 }
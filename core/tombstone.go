@@ -0,0 +1,352 @@
+package jikan
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// a tombstone hides the points in the stream's blocks from from to to,
+// inclusive, until the database is compacted and they're removed for good.
+// it only covers the points that were in the stream when it was made, so
+// block and count mark where the head of the stream was then: the position of
+// the head block and the number of points in it. an update is a tombstone
+// for a single time with the values that replace the points there.
+type tombstone struct {
+	from  time.Time
+	to    time.Time
+	block uint64
+	count uint32
+
+	// values is nil for points that were deleted
+	values []int64
+}
+
+// MAXIMUM_TOMBSTONES is the most deletions and updates that a stream can hold
+// at a time. Like late points, they're kept in the index.
+const MAXIMUM_TOMBSTONES = 4096
+
+var (
+	ERR_TOO_MANY_TOMBSTONES = errors.New("too many deletions and updates; compact the database to remove them")
+	ERR_NO_POINT            = errors.New("stream has no point at that time")
+)
+
+// DeleteRange deletes every point in the stream from from to to, inclusive, as
+// the bounds of an iterator are. Points added after it, even in the same
+// transaction, aren't affected.
+//
+// Points in the stream's blocks are only hidden until the database is
+// compacted, which removes them, so Count still includes them until then, and
+// aggregations have to decode every point in any range that has deletions in
+// it. Rollups aren't changed for steps that have already been rolled up.
+func (s *StreamTx) DeleteRange(from, to time.Time) error {
+	log.Debugf("deleting points from %s to %s\n", from, to)
+
+	if to.Before(from) || s.s.Count() == 0 {
+		return nil
+	}
+
+	in := func(t time.Time) bool {
+		return !t.Before(from) && !t.After(to)
+	}
+
+	// late points aren't in the blocks, so they can just be dropped, and so can
+	// any updates, since the tombstone covers the points that they replaced
+	var late []latePoint
+	for _, p := range s.s.late {
+		if !in(p.t) {
+			late = append(late, p)
+		}
+	}
+
+	var tombstones []tombstone
+	for _, d := range s.s.tombstones {
+		if d.values == nil || !in(d.from) {
+			tombstones = append(tombstones, d)
+		}
+	}
+
+	return s.bury(late, tombstones, tombstone{from: from, to: to})
+}
+
+// Update replaces the value of the point in an integer stream with a single
+// field at t. If the stream has more than one point at t, they're all replaced
+// with a single one, and if it doesn't have any, it returns ERR_NO_POINT.
+//
+// Updates are kept like deletions (see DeleteRange) until the database is
+// compacted.
+func (s *StreamTx) Update(t time.Time, v int64) error {
+	if len(s.s.head.types) != 1 {
+		return ERR_WRONG_FIELD_COUNT
+	}
+
+	if s.s.head.types[0] != TYPE_INT64 {
+		return ERR_WRONG_VALUE_TYPE
+	}
+
+	return s.update(t, []int64{v})
+}
+
+// UpdateFloat replaces the value of the point in a float stream with a single
+// field at t, as Update does.
+func (s *StreamTx) UpdateFloat(t time.Time, v float64) error {
+	if len(s.s.head.types) != 1 {
+		return ERR_WRONG_FIELD_COUNT
+	}
+
+	if s.s.head.types[0] != TYPE_FLOAT64 {
+		return ERR_WRONG_VALUE_TYPE
+	}
+
+	return s.update(t, []int64{int64(math.Float64bits(v))})
+}
+
+// UpdateRow replaces the point at t, as Update does, with one that has a value
+// for each of the stream's fields, in order, as AddRow takes them.
+func (s *StreamTx) UpdateRow(t time.Time, values ...interface{}) error {
+	vs, err := s.row(values)
+	if err != nil {
+		return err
+	}
+
+	return s.update(t, vs)
+}
+
+// update replaces the points at t with one that has the given values, as
+// they're stored.
+func (s *StreamTx) update(t time.Time, vs []int64) error {
+	t = time.Unix(0, t.Truncate(s.s.head.precision.Duration()).UnixNano())
+
+	log.Debugf("updating points at %s\n", t)
+
+	it := s.s.Iterator()
+	if err := it.Seek(t); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if !it.Good() || !it.Time.Equal(t) {
+		return ERR_NO_POINT
+	}
+
+	var late []latePoint
+	for _, p := range s.s.late {
+		if !p.t.Equal(t) {
+			late = append(late, p)
+		}
+	}
+
+	var tombstones []tombstone
+	for _, d := range s.s.tombstones {
+		if d.values == nil || !d.from.Equal(t) {
+			tombstones = append(tombstones, d)
+		}
+	}
+
+	return s.bury(late, tombstones, tombstone{from: t, to: t, values: append([]int64(nil), vs...)})
+}
+
+// bury replaces the stream's late points and tombstones, adding a new
+// tombstone that's marked with the current head of the stream. the lists are
+// replaced rather than changed in place, like the late points.
+func (s *StreamTx) bury(late []latePoint, tombstones []tombstone, d tombstone) error {
+	if len(tombstones) >= MAXIMUM_TOMBSTONES {
+		return ERR_TOO_MANY_TOMBSTONES
+	}
+
+	d.block = s.s.head.position
+	d.count = s.s.head.count
+
+	s.s.late = late
+	s.s.tombstones = append(tombstones, d)
+	s.buried = true
+
+	return nil
+}
+
+// tombstonesBetween reports whether any of the stream's tombstones cover a time
+// from from up to (but not including) to. either can be zero, for no limit.
+func (s *Stream) tombstonesBetween(from, to time.Time) bool {
+	for _, d := range s.tombstones {
+		if !d.to.Before(from) && (to.IsZero() || d.from.Before(to)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markTombstones finds the block that each tombstone was made at in a chain of
+// block positions, returning its index, or -1 if it isn't in the chain.
+func markTombstones(tombstones []tombstone, chain []uint64) []int {
+	marks := make([]int, len(tombstones))
+
+	for k, d := range tombstones {
+		marks[k] = -1
+
+		for n, position := range chain {
+			if position == d.block {
+				marks[k] = n
+			}
+		}
+	}
+
+	return marks
+}
+
+// buried reports whether a point at t, the nth point (counting from one) in
+// the block at index idx in the chain, is covered by any of the tombstones.
+// tombstones only cover the points that were in the stream when they were
+// made, which are the ones before their mark.
+func buried(tombstones []tombstone, marks []int, idx int, n uint32, t time.Time) bool {
+	for k, d := range tombstones {
+		if t.Before(d.from) || t.After(d.to) {
+			continue
+		}
+
+		if m := marks[k]; m >= 0 && (idx < m || (idx == m && n <= d.count)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replacements returns the points that updates replace others with, sorted by
+// time. there's only ever one update at each time.
+func replacements(tombstones []tombstone) []latePoint {
+	var points []latePoint
+
+	for _, d := range tombstones {
+		if d.values == nil {
+			continue
+		}
+
+		n := sort.Search(len(points), func(k int) bool {
+			return points[k].t.After(d.from)
+		})
+
+		points = append(points, latePoint{})
+		copy(points[n+1:], points[n:])
+		points[n] = latePoint{t: d.from, vs: d.values}
+	}
+
+	return points
+}
+
+// mergeLate merges two sorted lists of points, with the points from a first
+// when they're at the same time.
+func mergeLate(a, b []latePoint) []latePoint {
+	if len(a) == 0 {
+		return b
+	}
+
+	points := make([]latePoint, 0, len(a)+len(b))
+
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].t.Before(a[0].t) {
+			points, b = append(points, b[0]), b[1:]
+		} else {
+			points, a = append(points, a[0]), a[1:]
+		}
+	}
+
+	return append(append(points, a...), b...)
+}
+
+// tombstones are stored in the index as a count (uint32), and then for each
+// one:
+//
+//   0   start of the range in nanoseconds (uint64)
+//   8   end of the range in nanoseconds (uint64)
+//   16  position of the head block when it was made (uint64)
+//   24  points in the head block when it was made (uint32)
+//   28  1 if it's an update, 0 if it's a deletion
+//   29  for updates, the value of each field (uint64 each)
+
+func encodeTombstones(tombstones []tombstone) []byte {
+	d := make([]byte, 4)
+
+	binary.BigEndian.PutUint32(d, uint32(len(tombstones)))
+
+	for _, t := range tombstones {
+		var buf [29]byte
+
+		binary.BigEndian.PutUint64(buf[0:8], uint64(t.from.UnixNano()))
+		binary.BigEndian.PutUint64(buf[8:16], uint64(t.to.UnixNano()))
+		binary.BigEndian.PutUint64(buf[16:24], t.block)
+		binary.BigEndian.PutUint32(buf[24:28], t.count)
+
+		if t.values != nil {
+			buf[28] = 1
+		}
+
+		d = append(d, buf[:]...)
+
+		for _, v := range t.values {
+			binary.BigEndian.PutUint64(buf[0:8], uint64(v))
+			d = append(d, buf[0:8]...)
+		}
+	}
+
+	return d
+}
+
+func decodeTombstones(d []byte, fields int) ([]tombstone, bool) {
+	if len(d) < 4 {
+		return nil, false
+	}
+
+	count := int(binary.BigEndian.Uint32(d[0:4]))
+	if count > MAXIMUM_TOMBSTONES {
+		return nil, false
+	}
+
+	tombstones := make([]tombstone, count)
+
+	o := 4
+	for i := range tombstones {
+		if o+29 > len(d) || d[o+28] > 1 {
+			return nil, false
+		}
+
+		t := &tombstones[i]
+
+		t.from = time.Unix(0, int64(binary.BigEndian.Uint64(d[o:o+8])))
+		t.to = time.Unix(0, int64(binary.BigEndian.Uint64(d[o+8:o+16])))
+		t.block = binary.BigEndian.Uint64(d[o+16 : o+24])
+		t.count = binary.BigEndian.Uint32(d[o+24 : o+28])
+
+		update := d[o+28] == 1
+		o += 29
+
+		if t.to.Before(t.from) || (update && !t.to.Equal(t.from)) {
+			return nil, false
+		}
+
+		if !update {
+			continue
+		}
+
+		if o+8*fields > len(d) {
+			return nil, false
+		}
+
+		t.values = make([]int64, fields)
+
+		for k := range t.values {
+			t.values[k] = int64(binary.BigEndian.Uint64(d[o : o+8]))
+			o += 8
+		}
+	}
+
+	if o != len(d) {
+		return nil, false
+	}
+
+	return tombstones, true
+}
@@ -0,0 +1,161 @@
+package jikan
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ValueType is the type of the values in a stream. It's stored in each block,
+// and decides how value deltas are worked out and encoded.
+type ValueType uint8
+
+const (
+	TYPE_INT64   ValueType = 0
+	TYPE_FLOAT64 ValueType = 1
+)
+
+var (
+	ERR_BAD_VALUE_TYPE   = errors.New("unknown value type")
+	ERR_WRONG_VALUE_TYPE = errors.New("value doesn't match the type of the stream")
+)
+
+// ParseValueType turns a type name ("int" or "float") into a ValueType.
+func ParseValueType(s string) (ValueType, error) {
+	switch s {
+	case "int":
+		return TYPE_INT64, nil
+	case "float":
+		return TYPE_FLOAT64, nil
+	}
+
+	return 0, ERR_BAD_VALUE_TYPE
+}
+
+func (t ValueType) String() string {
+	switch t {
+	case TYPE_INT64:
+		return "int"
+	case TYPE_FLOAT64:
+		return "float"
+	}
+
+	return "unknown"
+}
+
+func (t ValueType) valid() bool {
+	return t == TYPE_INT64 || t == TYPE_FLOAT64
+}
+
+// values are kept as int64 everywhere below the API. floats are kept as their
+// IEEE 754 bits, and their deltas are the XOR of successive values, as in
+// Facebook's Gorilla. values that change slowly share their sign, exponent and
+// high bits of mantissa, so the XOR is mostly zeroes.
+
+// delta returns the delta to store to get from prev to v.
+func (t ValueType) delta(prev, v int64) int64 {
+	if t == TYPE_FLOAT64 {
+		return prev ^ v
+	}
+
+	return v - prev
+}
+
+// apply returns the value that a stored delta leads to from prev.
+func (t ValueType) apply(prev, delta int64) int64 {
+	if t == TYPE_FLOAT64 {
+		return prev ^ delta
+	}
+
+	return prev + delta
+}
+
+// float returns a value as a float64.
+func (t ValueType) float(v int64) float64 {
+	if t == TYPE_FLOAT64 {
+		return math.Float64frombits(uint64(v))
+	}
+
+	return float64(v)
+}
+
+// integer returns a value as an int64, truncating floats.
+func (t ValueType) integer(v int64) int64 {
+	if t == TYPE_FLOAT64 {
+		return int64(math.Float64frombits(uint64(v)))
+	}
+
+	return v
+}
+
+// putDelta encodes a value delta. integer deltas are signed varints. float
+// deltas are stored as a control byte, holding the number of leading zero
+// bytes in the high nibble and the number of bytes that follow in the low one,
+// then the bytes between the leading and trailing zeroes. a delta of zero
+// (a repeated value) is just the control byte.
+func (t ValueType) putDelta(buf []byte, delta int64) int {
+	if t != TYPE_FLOAT64 {
+		return binary.PutVarint(buf, delta)
+	}
+
+	x := uint64(delta)
+	if x == 0 {
+		buf[0] = 0
+		return 1
+	}
+
+	lead := 0
+	for x>>uint(56-8*lead) == 0 {
+		lead++
+	}
+
+	trail := 0
+	for x>>uint(8*trail)&0xff == 0 {
+		trail++
+	}
+
+	n := 8 - lead - trail
+
+	buf[0] = byte(lead<<4 | n)
+
+	x >>= uint(8 * trail)
+	for i := n; i > 0; i-- {
+		buf[i] = byte(x)
+		x >>= 8
+	}
+
+	return n + 1
+}
+
+// readDelta decodes a value delta, returning it and the number of bytes read.
+// as with binary.Varint, n is 0 if the buffer is too short, and negative if
+// the delta is malformed.
+func (t ValueType) readDelta(d []byte) (int64, int) {
+	if t != TYPE_FLOAT64 {
+		return binary.Varint(d)
+	}
+
+	if len(d) == 0 {
+		return 0, 0
+	}
+
+	if d[0] == 0 {
+		return 0, 1
+	}
+
+	lead, n := int(d[0]>>4), int(d[0]&0xf)
+	if n == 0 || lead+n > 8 {
+		return 0, -1
+	}
+
+	if len(d) < n+1 {
+		return 0, 0
+	}
+
+	var x uint64
+	for i := 1; i <= n; i++ {
+		x = x<<8 | uint64(d[i])
+	}
+
+	return int64(x << uint(8*(8-lead-n))), n + 1
+}
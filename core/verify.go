@@ -0,0 +1,263 @@
+package jikan
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/demizer/go-elog"
+	"github.com/facebookgo/stackerr"
+)
+
+// Problem is something wrong with a database, found by Verify. Stream is nil
+// for problems that don't belong to any particular stream.
+type Problem struct {
+	Stream   []byte
+	Position uint64
+	Message  string
+}
+
+func (p Problem) String() string {
+	if p.Stream == nil {
+		return fmt.Sprintf("%d: %s", p.Position, p.Message)
+	}
+
+	return fmt.Sprintf("`%s' %d: %s", p.Stream, p.Position, p.Message)
+}
+
+// cause returns the original error that was wrapped up by stackerr.
+func cause(err error) error {
+	errs := stackerr.Underlying(err)
+
+	return errs[len(errs)-1]
+}
+
+// region is a span of the file that's claimed by something, used to check
+// that nothing overlaps.
+type region struct {
+	position uint64
+	length   uint64
+	stream   []byte
+	what     string
+}
+
+type regionsByPosition []region
+
+func (r regionsByPosition) Len() int           { return len(r) }
+func (r regionsByPosition) Less(i, j int) bool { return r[i].position < r[j].position }
+func (r regionsByPosition) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// Verify checks the structure of the database: that the index, every block in
+// every stream and the free list fit in the file without overlapping, that
+// block chains don't loop, and that every record can be decoded, with times
+// that never go backwards and values that match the summary in the block's
+// header. It returns everything that it finds wrong; the error is only for
+// problems that stop it from checking at all.
+func (db *Database) Verify() ([]Problem, error) {
+	log.Debugf("verifying database\n")
+
+	db.RLock()
+	defer db.RUnlock()
+
+	var problems []Problem
+
+	report := func(stream []byte, position uint64, format string, args ...interface{}) {
+		p := Problem{
+			Stream:   stream,
+			Position: position,
+			Message:  fmt.Sprintf(format, args...),
+		}
+
+		log.Debugf("problem: %s\n", p)
+
+		problems = append(problems, p)
+	}
+
+	if db.used > uint64(len(db.mm)) {
+		report(nil, db.used, "used length is past the end of the file (%d bytes)", len(db.mm))
+	}
+
+	regions := []region{
+		{position: 0, length: db.base + headerLength(db.version), what: "header"},
+	}
+
+	if db.index != 0 {
+		regions = append(regions, region{position: db.index, length: db.indexLength, what: "index"})
+	}
+
+	for _, list := range [][]*dbFree{db.free, db.pending, db.released} {
+		for _, f := range list {
+			regions = append(regions, region{position: f.position, length: f.length, what: "free region"})
+		}
+	}
+
+	for i, r := range db.roots {
+		for _, o := range db.roots[:i] {
+			if bytes.Equal(o.id, r.id) {
+				report(r.id, r.position, "stream appears in the index more than once")
+			}
+		}
+
+		if d := r.property(PROPERTY_SCHEMA); d != nil {
+			if _, ok := decodeSchema(d); !ok {
+				report(r.id, db.index, "couldn't decode the stream's schema")
+			}
+		}
+
+		if d := r.property(PROPERTY_METADATA); d != nil {
+			if _, ok := decodeMetadata(d); !ok {
+				report(r.id, db.index, "couldn't decode the stream's metadata")
+			}
+		}
+
+		if d := r.property(PROPERTY_ROLLUPS); d != nil {
+			if _, ok := decodeRollups(d); !ok {
+				report(r.id, db.index, "couldn't decode the stream's rollups")
+			}
+		}
+
+		if d := r.property(PROPERTY_RETENTION); d != nil {
+			if _, ok := decodeRetention(d); !ok {
+				report(r.id, db.index, "couldn't decode the stream's retention")
+			}
+		}
+
+		if d := r.property(PROPERTY_DUPLICATES); d != nil {
+			if _, ok := decodeDuplicates(d); !ok {
+				report(r.id, db.index, "couldn't decode the stream's duplicate policy")
+			}
+		}
+
+		// late points and updates have a value for each field in the stream's
+		// blocks
+		if d := r.property(PROPERTY_LATE); d != nil {
+			if b, err := db.getBlock(r.position); err == nil {
+				if _, _, ok := decodeLate(d, len(b.types)); !ok {
+					report(r.id, db.index, "couldn't decode the stream's late points")
+				}
+			}
+		}
+
+		if d := r.property(PROPERTY_TOMBSTONES); d != nil {
+			if b, err := db.getBlock(r.position); err == nil {
+				if _, ok := decodeTombstones(d, len(b.types)); !ok {
+					report(r.id, db.index, "couldn't decode the stream's tombstones")
+				}
+			}
+		}
+
+		regions = append(regions, db.verifyStream(r, report)...)
+	}
+
+	if db.version >= 5 && !db.labels.equal(buildLabels(db.roots)) {
+		report(nil, db.index, "label index doesn't match the labels of the streams")
+	}
+
+	sort.Sort(regionsByPosition(regions))
+
+	var end uint64
+	var last region
+	for i, r := range regions {
+		if r.position+r.length > db.used {
+			report(r.stream, r.position, "%s is past the end of the used space", r.what)
+		}
+
+		if i > 0 && r.position < end {
+			report(r.stream, r.position, "%s overlaps %s at %d", r.what, last.what, last.position)
+		}
+
+		if r.position+r.length > end {
+			end = r.position + r.length
+			last = r
+		}
+	}
+
+	return problems, nil
+}
+
+// verifyStream walks the block chain of a stream, returning the regions that
+// its blocks occupy.
+func (db *Database) verifyStream(r *dbRoot, report func([]byte, uint64, string, ...interface{})) []region {
+	log.Debugf("verifying stream `%s'\n", r.id)
+
+	var regions []region
+	var last time.Time
+
+	seen := make(map[uint64]bool)
+
+	for position := r.position; position != 0; {
+		if seen[position] {
+			report(r.id, position, "block chain loops back on itself")
+			break
+		}
+
+		seen[position] = true
+
+		b, err := db.getBlock(position)
+		if err != nil {
+			report(r.id, position, "couldn't read block: %s", cause(err))
+			break
+		}
+
+		regions = append(regions, region{
+			position: position,
+			length:   b.size(),
+			stream:   r.id,
+			what:     "block",
+		})
+
+		var count uint32
+		var t time.Time
+
+		unit := b.precision.Duration()
+
+		err = b.records(func(n uint32, tdelta int64, vdeltas []int64) error {
+			if t.IsZero() {
+				t = time.Unix(0, 0).Add(time.Duration(tdelta) * unit)
+			} else {
+				if tdelta < 0 {
+					report(r.id, position, "time goes backwards in record %d", count)
+				}
+
+				t = t.Add(time.Duration(tdelta) * unit)
+			}
+
+			if count == 0 && !t.Equal(b.startTime) {
+				report(r.id, position, "header says block starts at %s, but it starts at %s", b.startTime.Format(time.RFC3339Nano), t.Format(time.RFC3339Nano))
+			}
+
+			if count == 0 && t.Before(last) {
+				report(r.id, position, "block starts at %s, before the end of the previous block at %s", t.Format(time.RFC3339Nano), last.Format(time.RFC3339Nano))
+			}
+
+			// the rest of the run is at the same interval, so it's the last point
+			// in it that matters from here on
+			t = t.Add(time.Duration(tdelta) * unit * time.Duration(n-1))
+			count += n
+
+			return nil
+		})
+		if err != nil {
+			report(r.id, position, "couldn't decode records: %s", cause(err))
+		} else if count != b.count {
+			report(r.id, position, "header says there are %d points, but found %d", b.count, count)
+		}
+
+		if err == nil && count == b.count && count > 0 && b.summarized() {
+			if summary, err := b.summarize(); err != nil {
+				report(r.id, position, "couldn't decode points: %s", cause(err))
+			} else if !summary.equal(b.summary) {
+				report(r.id, position, "header summary doesn't match the points in the block")
+			}
+		}
+
+		if count > 0 {
+			last = t
+		}
+
+		position = b.next
+	}
+
+	return regions
+}
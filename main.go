@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/csv"
+	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/cli"
@@ -20,7 +22,7 @@ func exportAction(c *cli.Context) {
 		os.Exit(1)
 	}
 
-	s, err := db.Stream([]byte(c.Args().Get(1)))
+	s, err := db.LookupStream([]byte(c.Args().Get(1)))
 	if err != nil {
 		log.Critical(err)
 		os.Exit(1)
@@ -32,19 +34,50 @@ func exportAction(c *cli.Context) {
 	if outfile == "" || outfile == "-" {
 		outf = os.Stdout
 	} else {
-		if outf, err = os.OpenFile(outfile, os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		if outf, err = os.OpenFile(outfile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
 			log.Critical(err)
 			os.Exit(1)
 		}
 	}
 
+	it := s.Iterator()
+
+	if from := c.String("from"); from != "" {
+		t, err := time.Parse(time.RFC3339Nano, from)
+		if err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+
+		it.From(t)
+	}
+
+	if to := c.String("to"); to != "" {
+		t, err := time.Parse(time.RFC3339Nano, to)
+		if err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+
+		it.To(t)
+	}
+
 	w := csv.NewWriter(outf)
 
-	for it := s.Iterator(); it.Good(); it.Next() {
-		w.Write([]string{
-			it.Time.Format(time.RFC3339Nano),
-			strconv.FormatInt(it.Value, 10),
-		})
+	fields := s.Fields()
+
+	for ; it.Good(); it.Next() {
+		record := []string{it.Time.Format(time.RFC3339Nano)}
+
+		for i, f := range fields {
+			if f.Type == jikan.TYPE_FLOAT64 {
+				record = append(record, formatFloat(it.FloatField(i)))
+			} else {
+				record = append(record, strconv.FormatInt(it.Field(i), 10))
+			}
+		}
+
+		w.Write(record)
 	}
 
 	w.Flush()
@@ -65,14 +98,122 @@ func exportAction(c *cli.Context) {
 	}
 }
 
-func importAction(c *cli.Context) {
+func queryAction(c *cli.Context) {
 	db, err := jikan.Open(c.Args().Get(0))
 	if err != nil {
 		log.Critical(err)
 		os.Exit(1)
 	}
 
-	s, err := db.Stream([]byte(c.Args().Get(1)))
+	s, err := db.LookupStream([]byte(c.Args().Get(1)))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	var outf io.WriteCloser
+
+	outfile := c.Args().Get(2)
+	if outfile == "" || outfile == "-" {
+		outf = os.Stdout
+	} else {
+		if outf, err = os.OpenFile(outfile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+	}
+
+	var from, to time.Time
+	var step time.Duration
+
+	if f := c.String("from"); f != "" {
+		if from, err = time.Parse(time.RFC3339Nano, f); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+	}
+
+	if t := c.String("to"); t != "" {
+		if to, err = time.Parse(time.RFC3339Nano, t); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+	}
+
+	if st := c.String("step"); st != "" {
+		if step, err = parseDuration(st); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+	}
+
+	fn, err := jikan.ParseAggregation(c.String("fn"))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if field := c.String("field"); field != "" {
+		fn.Field = -1
+
+		for i, f := range s.Fields() {
+			if f.Name == field {
+				fn.Field = i
+			}
+		}
+	}
+
+	buckets, err := s.Aggregate(from, to, step, fn)
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	w := csv.NewWriter(outf)
+
+	for _, b := range buckets {
+		w.Write([]string{
+			b.Start.Format(time.RFC3339Nano),
+			strconv.FormatUint(b.Count, 10),
+			strconv.FormatFloat(b.Value, 'f', -1, 64),
+		})
+	}
+
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if err := outf.Close(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if err := db.Close(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+}
+
+// parseDuration is like time.ParseDuration, but also takes a number of days,
+// like "30d".
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+func importAction(c *cli.Context) {
+	db, err := jikan.Open(c.Args().Get(0))
 	if err != nil {
 		log.Critical(err)
 		os.Exit(1)
@@ -90,29 +231,130 @@ func importAction(c *cli.Context) {
 		}
 	}
 
-	r := csv.NewReader(inf)
+	// the whole file is read up front, so that the value types of a new stream
+	// can be worked out from all of its values. every record has to have the
+	// same number of columns, which is one per field after the time.
+	records, err := csv.NewReader(inf).ReadAll()
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
 
-	err = s.WithTx(func(tx *jikan.StreamTx) error {
-		for {
-			record, err := r.Read()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return err
+	var options jikan.StreamOptions
+
+	if precision := c.String("precision"); precision != "" {
+		if options.Precision, err = jikan.ParsePrecision(precision); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+	}
+
+	if codec := c.String("codec"); codec != "" {
+		if options.Codec, err = jikan.ParseCodec(codec); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+	}
+
+	columns := 1
+	if len(records) > 0 {
+		columns = len(records[0]) - 1
+	}
+
+	if columns < 1 {
+		log.Critical(jikan.ERR_WRONG_FIELD_COUNT)
+		os.Exit(1)
+	}
+
+	types := make([]jikan.ValueType, columns)
+
+	for _, record := range records {
+		for i, v := range record[1:] {
+			if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+				types[i] = jikan.TYPE_FLOAT64
 			}
+		}
+	}
+
+	// a single column makes a plain stream, unless its field is named
+	var names []string
+	if f := c.String("fields"); f != "" {
+		names = strings.Split(f, ",")
+	} else if columns > 1 {
+		for i := range types {
+			names = append(names, fmt.Sprintf("field%d", i))
+		}
+	}
+
+	if names == nil {
+		options.Type = types[0]
+	} else if len(names) != columns {
+		log.Critical(jikan.ERR_WRONG_FIELD_COUNT)
+		os.Exit(1)
+	}
+
+	for i, name := range names {
+		options.Fields = append(options.Fields, jikan.Field{Name: name, Type: types[i]})
+	}
+
+	name := []byte(c.Args().Get(1))
+
+	s, err := db.LookupStream(name)
+	switch {
+	case err == jikan.ERR_STREAM_NOT_FOUND:
+		s, err = db.StreamWithOptions(name, options)
+	case err == nil && c.String("precision") != "" && s.Options().Precision != options.Precision:
+		err = jikan.ERR_STREAM_OPTIONS_MISMATCH
+	case err == nil && c.String("codec") != "" && s.Options().Codec != options.Codec:
+		err = jikan.ERR_STREAM_OPTIONS_MISMATCH
+	case err == nil && c.String("fields") != "" && !sameNames(s.Fields(), names):
+		err = jikan.ERR_STREAM_OPTIONS_MISMATCH
+	}
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if duplicates := c.String("duplicates"); duplicates != "" {
+		p, err := jikan.ParseDuplicatePolicy(duplicates)
+		if err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+
+		if err := s.SetDuplicates(p); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+	}
 
+	fields := s.Fields()
+
+	err = s.WithTx(func(tx *jikan.StreamTx) error {
+		for _, record := range records {
 			t, err := time.Parse(time.RFC3339Nano, record[0])
 			if err != nil {
 				return err
 			}
 
-			v, err := strconv.ParseInt(record[1], 10, 64)
-			if err != nil {
-				return err
+			if len(record)-1 != len(fields) {
+				return jikan.ERR_WRONG_FIELD_COUNT
 			}
 
-			if err := tx.Add(t, v); err != nil {
+			values := make([]interface{}, len(fields))
+
+			for i, f := range fields {
+				if f.Type == jikan.TYPE_FLOAT64 {
+					values[i], err = strconv.ParseFloat(record[i+1], 64)
+				} else {
+					values[i], err = strconv.ParseInt(record[i+1], 10, 64)
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			if err := tx.AddRow(t, values...); err != nil {
 				return err
 			}
 		}
@@ -130,6 +372,245 @@ func importAction(c *cli.Context) {
 	}
 }
 
+// sameNames reports whether fields have the given names, in order.
+func sameNames(fields []jikan.Field, names []string) bool {
+	if len(fields) != len(names) {
+		return false
+	}
+
+	for i, f := range fields {
+		if f.Name != names[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// formatFloat formats a float so that it's never mistaken for an integer when
+// it's imported again.
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+
+	if strings.IndexAny(s, ".eIN") == -1 {
+		s += ".0"
+	}
+
+	return s
+}
+
+func listAction(c *cli.Context) {
+	db, err := jikan.Open(c.Args().Get(0))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	matchers, err := jikan.ParseMatchers(c.String("selector"))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	streams, err := db.Select(matchers...)
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	w := csv.NewWriter(os.Stdout)
+
+	for _, s := range streams {
+		name := s.Name()
+
+		first, last, err := s.Range()
+		if err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+
+		record := []string{
+			string(name),
+			strconv.FormatUint(s.Count(), 10),
+			"",
+			"",
+		}
+
+		if !first.IsZero() {
+			record[2] = first.Format(time.RFC3339Nano)
+			record[3] = last.Format(time.RFC3339Nano)
+		}
+
+		w.Write(record)
+	}
+
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if err := db.Close(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+}
+
+func deleteAction(c *cli.Context) {
+	db, err := jikan.Open(c.Args().Get(0))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if err := db.DeleteStream([]byte(c.Args().Get(1))); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if err := db.Close(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+}
+
+func retainAction(c *cli.Context) {
+	db, err := jikan.Open(c.Args().Get(0))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	s, err := db.LookupStream([]byte(c.Args().Get(1)))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	var r jikan.Retention
+
+	if a := c.String("max-age"); a != "" {
+		if r.MaxAge, err = parseDuration(a); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+	}
+
+	if n := c.Int("max-points"); n > 0 {
+		r.MaxPoints = uint64(n)
+	}
+
+	count := s.Count()
+
+	if err := s.SetRetention(r); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("dropped %d points\n", count-s.Count())
+
+	if err := db.Close(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+}
+
+func compactAction(c *cli.Context) {
+	db, err := jikan.Open(c.Args().Get(0))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	saved, err := db.Compact(c.Args().Get(1))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("saved %d bytes\n", saved)
+
+	if err := db.Close(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+}
+
+func upgradeAction(c *cli.Context) {
+	version, err := jikan.Upgrade(c.Args().Get(0))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if version == jikan.FORMAT_VERSION {
+		fmt.Printf("already at version %d\n", version)
+	} else {
+		fmt.Printf("upgraded from version %d to %d\n", version, jikan.FORMAT_VERSION)
+	}
+}
+
+func verifyAction(c *cli.Context) {
+	db, err := jikan.Open(c.Args().Get(0))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	problems, err := db.Verify()
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	w := csv.NewWriter(os.Stdout)
+
+	for _, p := range problems {
+		w.Write([]string{
+			string(p.Stream),
+			strconv.FormatUint(p.Position, 10),
+			p.Message,
+		})
+	}
+
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if err := db.Close(); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	if len(problems) > 0 {
+		os.Exit(2)
+	}
+}
+
+func repairAction(c *cli.Context) {
+	report, err := jikan.Repair(c.Args().Get(0), c.Args().Get(1))
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+
+	for _, s := range report.Streams {
+		fmt.Printf("%s: recovered %d points, lost %d\n", s.Name, s.Recovered, s.Lost)
+	}
+
+	for _, p := range report.Problems {
+		fmt.Printf("lost: %s\n", p)
+	}
+
+	if len(report.Problems) > 0 {
+		os.Exit(2)
+	}
+}
+
 func main() {
 	log.SetFlags(log.Llabel | log.LshortFileName | log.LlineNumber)
 
@@ -151,12 +632,126 @@ func main() {
 			ShortName: "e",
 			Usage:     "Export the contents of a database",
 			Action:    exportAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "only export points at or after this time (RFC3339)",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "only export points at or before this time (RFC3339)",
+				},
+			},
+		},
+		{
+			Name:      "query",
+			ShortName: "q",
+			Usage:     "Aggregate a stream over intervals of time",
+			Action:    queryAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "start of the first interval (RFC3339, default the first point)",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "only aggregate points before this time (RFC3339)",
+				},
+				cli.StringFlag{
+					Name:  "step",
+					Usage: "length of each interval, like 1h or 30d (default everything in one)",
+				},
+				cli.StringFlag{
+					Name:  "fn",
+					Value: "mean",
+					Usage: "count, sum, min, max, mean, first, last, stddev, or a percentile like p99",
+				},
+				cli.StringFlag{
+					Name:  "field",
+					Usage: "name of the field to aggregate (default the first)",
+				},
+			},
 		},
 		{
 			Name:      "import",
 			ShortName: "i",
 			Usage:     "Import content to a database",
 			Action:    importAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "precision",
+					Usage: "time precision of a new stream: ns, us, ms or s (default ns)",
+				},
+				cli.StringFlag{
+					Name:  "codec",
+					Usage: "encoding of a new stream: rle, varint or gorilla (default rle)",
+				},
+				cli.StringFlag{
+					Name:  "fields",
+					Usage: "comma-separated names for the value columns of a new stream",
+				},
+				cli.StringFlag{
+					Name:  "duplicates",
+					Usage: "what the stream does with points at the same time as one it has: all, last, first or error",
+				},
+			},
+		},
+		{
+			Name:      "list",
+			ShortName: "l",
+			Usage:     "List the streams in a database",
+			Action:    listAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "selector",
+					Usage: "only list streams with all of these labels, like region=eu,host=~web.*",
+				},
+			},
+		},
+		{
+			Name:      "delete",
+			ShortName: "d",
+			Usage:     "Delete a stream from a database",
+			Action:    deleteAction,
+		},
+		{
+			Name:   "retain",
+			Usage:  "Limit how much of a stream is kept",
+			Action: retainAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "max-age",
+					Usage: "keep points this close to the stream's last point (not to now), like 30d or 12h",
+				},
+				cli.IntFlag{
+					Name:  "max-points",
+					Usage: "keep this many points",
+				},
+			},
+		},
+		{
+			Name:      "compact",
+			ShortName: "c",
+			Usage:     "Write a compacted copy of a database",
+			Action:    compactAction,
+		},
+		{
+			Name:      "upgrade",
+			ShortName: "u",
+			Usage:     "Upgrade a database to the current format",
+			Action:    upgradeAction,
+		},
+		{
+			Name:      "verify",
+			ShortName: "v",
+			Usage:     "Check the integrity of a database",
+			Action:    verifyAction,
+		},
+		{
+			Name:      "repair",
+			ShortName: "r",
+			Usage:     "Salvage what can be read from a damaged database",
+			Action:    repairAction,
 		},
 	}
 